@@ -2,6 +2,8 @@ package api
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/costinul/git-rest-cache/config"
 	"github.com/costinul/git-rest-cache/gitcache"
@@ -15,18 +17,53 @@ type CacheAPI struct {
 	cfg      *config.Config
 }
 
+type routeAction struct {
+	name    string
+	param   string
+	handler func(gitCache *gitcache.GitCache) gin.HandlerFunc
+}
+
+// routeActions are the actions available on a ref. Actions with a param
+// take the rest of the URL as a path.
+var routeActions = []routeAction{
+	{"blob", "filepath", getGitBlobHandler},
+	{"raw", "filepath", getGitRawHandler},
+	{"list", "path", getGitListHandler},
+	{"log", "path", getGitLogHandler},
+	{"info", "", getGitRefInfoHandler},
+}
+
+// compareAction compares two refs of a repo, at <repo path>/compare/<base>...<head>.
+// It takes the place of the actions of a ref named like it.
+const compareAction = "compare"
+
 func NewCacheAPI(cfg *config.Config, gitCache *gitcache.GitCache, providerManager provider.ProviderManager) *CacheAPI {
 	router := gin.Default()
 
 	providers := providerManager.GetProviders()
 	for _, p := range providers {
-		blobPath := fmt.Sprintf("%v/:branch/blob/*filepath", p.GetURLPath())
-		router.GET(blobPath, authMiddleware(gitCache, p), getGitBlobHandler(gitCache))
+		if nested, ok := p.(provider.NestedProvider); ok && nested.IsNested() {
+			router.GET(p.GetURLPath()+"/*nestedPath", nestedRouteHandler(gitCache, p))
+			continue
+		}
+
+		router.GET(p.GetURLPath()+"/"+compareAction+"/*basehead", authMiddleware(gitCache, p), getGitCompareHandler(gitCache))
 
-		listPath := fmt.Sprintf("%v/:branch/list/*path", p.GetURLPath())
-		router.GET(listPath, authMiddleware(gitCache, p), getGitListHandler(gitCache))
+		for _, action := range routeActions {
+			actionPath := fmt.Sprintf("%v/:ref/%s", p.GetURLPath(), action.name)
+			if action.param != "" {
+				actionPath += "/*" + action.param
+			}
+			router.GET(actionPath, authMiddleware(gitCache, p), action.handler(gitCache))
+		}
+	}
+
+	if cfg.WebhookSecret != "" {
+		registerWebhooks(router, gitCache, cfg.WebhookSecret)
 	}
 
+	router.GET("/stats", getStatsHandler(gitCache))
+
 	api := CacheAPI{
 		gin:      router,
 		gitCache: gitCache,
@@ -36,6 +73,93 @@ func NewCacheAPI(cfg *config.Config, gitCache *gitcache.GitCache, providerManage
 	return &api
 }
 
+// nestedRouteHandler routes <repo path...>/-/<ref>/<action>/<path> requests
+// for providers whose repo paths have a variable number of segments.
+func nestedRouteHandler(gitCache *gitcache.GitCache, p provider.Provider) gin.HandlerFunc {
+	handlers := make(map[string][]gin.HandlerFunc)
+	for _, action := range routeActions {
+		handlers[action.name] = []gin.HandlerFunc{authMiddleware(gitCache, p), action.handler(gitCache)}
+	}
+	compareHandlers := []gin.HandlerFunc{authMiddleware(gitCache, p), getGitCompareHandler(gitCache)}
+
+	return func(c *gin.Context) {
+		repoPath, ref, actionName, actionPath, ok := parseNestedPath(c.Param("nestedPath"))
+		if !ok {
+			c.String(http.StatusNotFound, "Not found")
+			return
+		}
+
+		// The refs compared take the place of the ref and the action.
+		if ref == compareAction {
+			c.Params = append(c.Params,
+				gin.Param{Key: provider.RepoPathParam, Value: repoPath},
+				gin.Param{Key: "basehead", Value: "/" + strings.TrimSuffix(actionName+actionPath, "/")},
+			)
+			runHandlers(c, compareHandlers)
+			return
+		}
+
+		var action *routeAction
+		for i := range routeActions {
+			if routeActions[i].name == actionName {
+				action = &routeActions[i]
+			}
+		}
+		if action == nil {
+			c.String(http.StatusNotFound, "Not found")
+			return
+		}
+
+		if action.param == "" && actionPath != "/" {
+			c.String(http.StatusNotFound, "Not found")
+			return
+		}
+
+		c.Params = append(c.Params,
+			gin.Param{Key: provider.RepoPathParam, Value: repoPath},
+			gin.Param{Key: "ref", Value: ref},
+		)
+		if action.param != "" {
+			c.Params = append(c.Params, gin.Param{Key: action.param, Value: actionPath})
+		}
+
+		runHandlers(c, handlers[action.name])
+	}
+}
+
+func runHandlers(c *gin.Context, handlers []gin.HandlerFunc) {
+	for _, handler := range handlers {
+		handler(c)
+		if c.IsAborted() {
+			return
+		}
+	}
+}
+
+func parseNestedPath(fullPath string) (repoPath, ref, action, actionPath string, ok bool) {
+	idx := strings.Index(fullPath, "/-/")
+	if idx < 0 {
+		return "", "", "", "", false
+	}
+
+	repoPath = strings.Trim(fullPath[:idx], "/")
+	if repoPath == "" {
+		return "", "", "", "", false
+	}
+
+	parts := strings.SplitN(fullPath[idx+3:], "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", "", false
+	}
+
+	actionPath = "/"
+	if len(parts) == 3 {
+		actionPath = "/" + parts[2]
+	}
+
+	return repoPath, parts[0], parts[1], actionPath, true
+}
+
 func (api *CacheAPI) Run() error {
 	return api.gin.Run(fmt.Sprintf(":%d", api.cfg.Port))
 }
@@ -61,3 +185,39 @@ func hasAccess(token string, gitCache *gitcache.GitCache, repo provider.Provider
 
 	return true, nil
 }
+
+// sharedRepo swaps the repo for its token-independent variant when the repo
+// is public, so that every token reading it shares a single clone.
+func sharedRepo(token string, gitCache *gitcache.GitCache, repo provider.ProviderRepo) (provider.ProviderRepo, error) {
+	if token == "" {
+		return repo, nil
+	}
+
+	anonymous := repo.Anonymous()
+	public, known := gitCache.IsPublic(anonymous.Hash())
+	if !known {
+		validToken, err := anonymous.ValidateToken("")
+		if err != nil {
+			return nil, err
+		}
+		public = validToken
+		gitCache.SetPublic(anonymous.Hash(), public)
+	}
+
+	if public {
+		return anonymous, nil
+	}
+
+	return repo, nil
+}
+
+// renewableURL lets the cache ask repos whose credentials expire for a new git
+// URL, since the one of this request is kept for background fetches.
+func renewableURL(gitCache *gitcache.GitCache, repo provider.ProviderRepo) error {
+	expiring, ok := repo.(provider.ExpiringRepo)
+	if !ok || !expiring.CredentialsExpire() {
+		return nil
+	}
+
+	return gitCache.SetURLSource(repo.Hash(), repo.GitURL(), repo.GitURL)
+}
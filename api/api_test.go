@@ -2,17 +2,22 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/costinul/git-rest-cache/config"
 	"github.com/costinul/git-rest-cache/gitcache"
+	"github.com/costinul/git-rest-cache/internal/gittest"
 	"github.com/costinul/git-rest-cache/provider"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockProviderManager struct {
@@ -34,8 +39,9 @@ func (m *mockProvider) GetURLPath() string {
 }
 
 func newMockProviderManager() *mockProviderManager {
+	defaultProvider, _ := provider.NewDefaultProviderManager(&config.Config{})
 	return &mockProviderManager{
-		defaultProvider: provider.NewDefaultProviderManager(),
+		defaultProvider: defaultProvider,
 	}
 }
 
@@ -75,6 +81,17 @@ func (r *mockProviderRepo) GitURL() string {
 	return r.gitRepo.GitURL()
 }
 
+func (r *mockProviderRepo) Origin() (string, string) {
+	return r.gitRepo.Origin()
+}
+
+func (r *mockProviderRepo) Anonymous() provider.ProviderRepo {
+	return &mockProviderRepo{
+		gitRepo: r.gitRepo.Anonymous(),
+		repo:    r.repo,
+	}
+}
+
 func (m *mockProviderRepo) ValidateToken(token string) (bool, error) {
 	if m.repo == "private-repo" {
 		if token == "valid-token" {
@@ -127,6 +144,7 @@ func TestAPIEndpoints(t *testing.T) {
 		token      string
 		wantStatus int
 		wantBody   string
+		wantCache  string
 	}{
 		{
 			name:       "Valid token for private repo",
@@ -151,6 +169,32 @@ func TestAPIEndpoints(t *testing.T) {
 			wantStatus: http.StatusOK,
 			wantBody:   "content for url=https://github.com/test/public-repo.git, branch=main, file=/file.txt",
 		},
+		{
+			name:       "Public repo with token shares the anonymous clone",
+			path:       "/github/test/public-repo/main/blob/file.txt",
+			method:     "GET",
+			token:      "some-token",
+			wantStatus: http.StatusOK,
+			wantBody:   "content for url=https://github.com/test/public-repo.git, branch=main, file=/file.txt",
+		},
+		{
+			name:       "Public repo pinned to a commit",
+			path:       "/github/test/public-repo/0123456789abcdef0123456789abcdef01234567/blob/file.txt",
+			method:     "GET",
+			token:      "",
+			wantStatus: http.StatusOK,
+			wantBody:   "content for url=https://github.com/test/public-repo.git, branch=0123456789abcdef0123456789abcdef01234567, file=/file.txt",
+			wantCache:  "public, max-age=31536000, immutable",
+		},
+		{
+			name:       "Private repo pinned to a commit",
+			path:       "/github/test/private-repo/0123456789abcdef0123456789abcdef01234567/blob/file.txt",
+			method:     "GET",
+			token:      "valid-token",
+			wantStatus: http.StatusOK,
+			wantBody:   "content for url=https://valid-token@github.com/test/private-repo.git, branch=0123456789abcdef0123456789abcdef01234567, file=/file.txt",
+			wantCache:  "private, max-age=31536000, immutable",
+		},
 		{
 			name:       "Public repo with inexistent file",
 			path:       "/github/test/public-repo/main/blob/notfound.txt",
@@ -179,6 +223,20 @@ func TestAPIEndpoints(t *testing.T) {
 			token:      "",
 			wantStatus: http.StatusNotFound,
 		},
+		{
+			name:       "Compare private repo refs with invalid token",
+			path:       "/github/test/private-repo/compare/main...dev",
+			method:     "GET",
+			token:      "invalid-token",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Compare without a range",
+			path:       "/github/test/public-repo/compare/main",
+			method:     "GET",
+			token:      "",
+			wantStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tt := range tests {
@@ -192,9 +250,532 @@ func TestAPIEndpoints(t *testing.T) {
 			}
 			router.ServeHTTP(w, req)
 			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+				assert.Equal(t, tt.wantCache, w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func TestNestedProviderRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.EscapedPath() == "/api/v4/projects/acme%2Fwidgets%2Fpublic-repo":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.EscapedPath() == "/api/v4/projects/acme%2Fwidgets%2Fprivate-repo" && r.Header.Get("PRIVATE-TOKEN") == "valid-token":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gitlab.Close()
+
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           10 * time.Minute,
+		RepoCheckInterval: 1 * time.Minute,
+		GitlabURL:         gitlab.URL,
+	}
+
+	gitCache := gitcache.NewGitCache(cfg, context.Background(), gitcache.NewTestGitManager(readFile, listTree))
+	providerManager, err := provider.NewDefaultProviderManager(cfg)
+	require.NoError(t, err)
+	api := NewCacheAPI(cfg, gitCache, providerManager)
+	router := api.Router()
+	host := strings.TrimPrefix(gitlab.URL, "http://")
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Blob from nested group",
+			path:       "/gitlab/acme/widgets/public-repo/-/main/blob/file.txt",
+			wantStatus: http.StatusOK,
+			wantBody:   fmt.Sprintf("content for url=http://%s/acme/widgets/public-repo.git, branch=main, file=/file.txt", host),
+		},
+		{
+			name:       "Private repo with valid token",
+			path:       "/gitlab/acme/widgets/private-repo/-/main/blob/file.txt",
+			token:      "valid-token",
+			wantStatus: http.StatusOK,
+			wantBody:   fmt.Sprintf("content for url=http://oauth2:valid-token@%s/acme/widgets/private-repo.git, branch=main, file=/file.txt", host),
+		},
+		{
+			name:       "Private repo without token",
+			path:       "/gitlab/acme/widgets/private-repo/-/main/blob/file.txt",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "List from nested group",
+			path:       "/gitlab/acme/widgets/public-repo/-/main/list/folder",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"hash":"9c955c2818ec5a99e62966f8ad2bd0f8a5d3d487","path":"folder/file.txt","type":"blob","size":100}]`,
+		},
+		{
+			name:       "Missing separator",
+			path:       "/gitlab/acme/widgets/public-repo/main/blob/file.txt",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Unknown action",
+			path:       "/gitlab/acme/widgets/public-repo/-/main/tree/file.txt",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", tt.path, nil)
+			assert.NoError(t, err)
+
+			if tt.token != "" {
+				req.Header.Set("X-Token", tt.token)
+			}
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+// newTestGitHost serves a repo.git with files over git's smart HTTP
+// protocol, to clients using the password "secret".
+func newTestGitHost(t *testing.T, files map[string]string) *httptest.Server {
+	return gittest.NewServer(t, files, []string{"repo.git"}, func(r *http.Request) bool {
+		_, password, ok := r.BasicAuth()
+		return ok && password == "secret"
+	})
+}
+
+func newTestGitHostRouter(t *testing.T, server *httptest.Server) *gin.Engine {
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           10 * time.Minute,
+		RepoCheckInterval: 1 * time.Minute,
+		GitHosts:          []config.GitHost{{Name: "local", URL: server.URL}},
+	}
+
+	gitManager, err := gitcache.NewGitCacheManager(gitcache.StorageModeWorktree)
+	require.NoError(t, err)
+	gitCache := gitcache.NewGitCache(cfg, context.Background(), gitManager)
+	providerManager, err := provider.NewDefaultProviderManager(cfg)
+	require.NoError(t, err)
+
+	return NewCacheAPI(cfg, gitCache, providerManager).Router()
+}
+
+func TestGitHostRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server := newTestGitHost(t, map[string]string{"file.txt": "served over http"})
+	router := newTestGitHostRouter(t, server)
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Blob with valid token",
+			path:       "/git/local/repo.git/-/main/blob/file.txt",
+			token:      "secret",
+			wantStatus: http.StatusOK,
+			wantBody:   "served over http",
+		},
+		{
+			name:       "Blob with invalid token",
+			path:       "/git/local/repo.git/-/main/blob/file.txt",
+			token:      "wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Unknown host",
+			path:       "/git/other/repo.git/-/main/blob/file.txt",
+			token:      "secret",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", tt.path, nil)
+			assert.NoError(t, err)
+
+			req.Header.Set("X-Token", tt.token)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
 			if tt.wantStatus == http.StatusOK {
 				assert.Equal(t, tt.wantBody, w.Body.String())
 			}
 		})
 	}
 }
+
+func TestConditionalRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server := newTestGitHost(t, map[string]string{"folder/file.txt": "polled often"})
+	router := newTestGitHostRouter(t, server)
+
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/git/local/repo.git/-/main/"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Token", "secret")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("blob/folder/file.txt", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{40}"$`, etag)
+	lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), lastModified, time.Minute)
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w = get("blob/folder/file.txt", map[string]string{"If-None-Match": ifNoneMatch})
+		assert.Equal(t, http.StatusNotModified, w.Code, ifNoneMatch)
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, etag, w.Header().Get("ETag"))
+	}
+
+	w = get("blob/folder/file.txt", map[string]string{"If-None-Match": `"other"`})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "polled often", w.Body.String())
+
+	w = get("list/folder", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	treeETag := w.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{40}"$`, treeETag)
+	assert.NotEqual(t, etag, treeETag)
+
+	w = get("list/folder", map[string]string{"If-None-Match": treeETag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = get("blob/folder", map[string]string{"If-None-Match": treeETag})
+	assert.Equal(t, http.StatusNotFound, w.Code, "a tree's ETag doesn't validate blob requests")
+
+	w = get("blob/missing.txt", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestRangeRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server := newTestGitHost(t, map[string]string{"file.txt": "0123456789"})
+	router := newTestGitHostRouter(t, server)
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/git/local/repo.git/-/main/blob/file.txt", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Token", "secret")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "10", w.Header().Get("Content-Length"))
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	etag := w.Header().Get("ETag")
+
+	w = get(map[string]string{"Range": "bytes=2-5"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "2345", w.Body.String())
+	assert.Equal(t, "bytes 2-5/10", w.Header().Get("Content-Range"))
+	assert.Equal(t, "4", w.Header().Get("Content-Length"))
+
+	w = get(map[string]string{"Range": "bytes=-3", "If-Range": etag})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "789", w.Body.String())
+
+	w = get(map[string]string{"Range": "bytes=-3", "If-Range": `"stale"`})
+	assert.Equal(t, http.StatusOK, w.Code, "a stale If-Range should get the whole file")
+	assert.Equal(t, "0123456789", w.Body.String())
+
+	w = get(map[string]string{"Range": "bytes=20-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func TestContentTypes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	server := newTestGitHost(t, map[string]string{
+		"index.html": "<html><script>alert(1)</script></html>",
+		"README":     "Héllo",
+		"latin1.txt": "H\xe9llo",
+		"image.png":  png,
+		"unnamed":    png,
+		"data.json":  `{"a": 1}`,
+		"app.ts":     "const greeting: string = 'hi'",
+		"view.tsx":   "<div>{greeting}</div>",
+		"main.rs":    "fn main() {}",
+	})
+	router := newTestGitHostRouter(t, server)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/git/local/repo.git/-/main/"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Token", "secret")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		path        string
+		contentType string
+	}{
+		{"blob/index.html", "text/html; charset=utf-8"},
+		{"blob/README", "text/plain; charset=utf-8"},
+		{"blob/latin1.txt", "text/plain"},
+		{"blob/image.png", "image/png"},
+		{"blob/unnamed", "image/png"},
+		{"blob/data.json", "application/json; charset=utf-8"},
+		{"blob/app.ts", "text/plain; charset=utf-8"},
+		{"blob/view.tsx", "text/plain; charset=utf-8"},
+		{"blob/main.rs", "text/plain; charset=utf-8"},
+		{"raw/index.html", "text/plain; charset=utf-8"},
+		{"raw/data.json", "text/plain; charset=utf-8"},
+		{"raw/image.png", "image/png"},
+	}
+
+	for _, tt := range tests {
+		w := get(tt.path)
+		require.Equal(t, http.StatusOK, w.Code, tt.path)
+		assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"), tt.path)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), tt.path)
+		assert.Contains(t, w.Header().Get("Content-Security-Policy"), "sandbox", tt.path)
+		assert.Empty(t, w.Header().Get("Content-Disposition"), tt.path)
+	}
+
+	w := get("raw/image.png?disposition=attachment")
+	assert.Equal(t, `attachment; filename=image.png`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, png, w.Body.String())
+
+	w = get("blob/README?disposition=inline")
+	assert.Equal(t, `inline; filename=README`, w.Header().Get("Content-Disposition"))
+
+	w = get("blob/README?disposition=download")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRecursiveListing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server := newTestGitHost(t, map[string]string{
+		"README.md":         "readme",
+		"docs/guide.md":     "guide",
+		"docs/img/logo.png": "png",
+		"src/main.go":       "package main",
+	})
+	router := newTestGitHostRouter(t, server)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", target, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Token", "secret")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	paths := func(items []gitcache.GitItem) []string {
+		var paths []string
+		for _, item := range items {
+			paths = append(paths, item.Path)
+		}
+		return paths
+	}
+
+	var items []gitcache.GitItem
+	w := get("/git/local/repo.git/-/main/list/?recursive=true&glob=*.md")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+	assert.Equal(t, []string{"README.md", "docs/guide.md"}, paths(items))
+	assert.Empty(t, w.Header().Get("Link"))
+
+	// Pages of two, following the Link header.
+	var paged []string
+	target := "/git/local/repo.git/-/main/list/?recursive=true&limit=2"
+	for target != "" {
+		w = get(target)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		items = nil
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+		assert.LessOrEqual(t, len(items), 2)
+		paged = append(paged, paths(items)...)
+
+		target = ""
+		if link := w.Header().Get("Link"); link != "" {
+			require.Regexp(t, `^<.+>; rel="next"$`, link)
+			target = link[1:strings.Index(link, ">")]
+		}
+	}
+	assert.Equal(t, []string{"README.md", "docs", "docs/guide.md", "docs/img", "docs/img/logo.png", "src", "src/main.go"}, paged)
+
+	w = get("/git/local/repo.git/-/main/list/?recursive=true&type=dir&format=ndjson")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	var item gitcache.GitItem
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &item))
+	assert.Equal(t, "docs/img", item.Path)
+
+	w = get("/git/local/repo.git/-/main/list/docs?recursive=true&max_depth=1&format=ndjson&limit=1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "\n"))
+	assert.Contains(t, w.Header().Get("Link"), "cursor=")
+
+	for _, query := range []string{"max_depth=2", "recursive=maybe", "type=file", "limit=0", "glob=[", "format=xml", "cursor=%21%21"} {
+		w = get("/git/local/repo.git/-/main/list/?" + query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	w = get("/git/local/repo.git/-/main/list/missing?recursive=true&format=ndjson")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDetectCharset(t *testing.T) {
+	assert.Equal(t, "utf-8", detectCharset([]byte("plain ascii"), false))
+	assert.Equal(t, "utf-8", detectCharset([]byte("cut in the middle of \xc3"), true))
+	assert.Equal(t, "", detectCharset([]byte("cut in the middle of \xc3"), false))
+	assert.Equal(t, "utf-16le", detectCharset([]byte("\xff\xfeh\x00i\x00"), false))
+	assert.Equal(t, "", detectCharset([]byte("latin-1 \xe9t\xe9"), false))
+}
+
+func TestLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server := newTestGitHost(t, map[string]string{"folder/file.txt": "history"})
+	router := newTestGitHostRouter(t, server)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Token", "secret")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/git/local/repo.git/-/main/log/folder/file.txt?limit=10")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var history gitcache.CommitLog
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history.Commits, 1)
+	assert.Equal(t, "initial", history.Commits[0].Message)
+	assert.Equal(t, "test", history.Commits[0].Author.Name)
+
+	w = get("/git/local/repo.git/-/main/log/folder/file.txt?since=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Empty(t, history.Commits)
+
+	for _, query := range []string{"limit=0", "limit=1001", "since=yesterday", "until=2024-01-01"} {
+		assert.Equal(t, http.StatusBadRequest, get("/git/local/repo.git/-/main/log/?"+query).Code, query)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	server := newTestGitHost(t, map[string]string{"file.txt": "compared"})
+	router := newTestGitHostRouter(t, server)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Token", "secret")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/git/local/repo.git/-/compare/main...main?patch=true")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var comparison gitcache.Comparison
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &comparison))
+	assert.Len(t, comparison.BaseCommit, 40)
+	assert.Equal(t, comparison.BaseCommit, comparison.HeadCommit)
+	assert.Empty(t, comparison.Files)
+
+	assert.Equal(t, http.StatusNotFound, get("/git/local/repo.git/-/compare/main...missing").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/git/local/repo.git/-/compare/main..main").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/git/local/repo.git/-/compare/main...main?patch=maybe").Code)
+}
+
+func TestRefInfo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           10 * time.Minute,
+		RepoCheckInterval: 1 * time.Minute,
+	}
+
+	gitCache := gitcache.NewGitCache(cfg, context.Background(), gitcache.NewTestGitManager(readFile, listTree))
+	router := NewCacheAPI(cfg, gitCache, newMockProviderManager()).Router()
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/github/test/public-repo/main/info", nil)
+	require.NoError(t, err)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var status gitcache.RefStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "main", status.Ref)
+	assert.Equal(t, "branch", status.Kind)
+	assert.WithinDuration(t, time.Now(), status.LastChecked, time.Minute)
+}
+
+func TestStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           10 * time.Minute,
+		RepoCheckInterval: 1 * time.Minute,
+		BlobCacheBytes:    1 << 20,
+	}
+
+	gitCache := gitcache.NewGitCache(cfg, context.Background(), gitcache.NewTestGitManager(readFile, listTree))
+	router := NewCacheAPI(cfg, gitCache, newMockProviderManager()).Router()
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/stats", nil)
+	require.NoError(t, err)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var stats struct {
+		BlobCache gitcache.BlobCacheStats `json:"blob_cache"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, gitcache.BlobCacheStats{Enabled: true, MaxBytes: 1 << 20}, stats.BlobCache)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// blobContentSecurityPolicy keeps HTML and SVG files from repos from running
+// scripts or loading anything under our origin, like raw.githubusercontent.com.
+const blobContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
+// sniffLength is how much of a file is read to detect its type and charset,
+// the same as http.DetectContentType considers.
+const sniffLength = 512
+
+// contentTypes maps file extensions to media types. The table is fixed,
+// rather than read from the host's mime.types like mime.TypeByExtension does,
+// so that every host serves a file with the same type. Source code is plain
+// text, as many of its extensions are registered for unrelated types, like
+// .ts for Qt translations or .rs for RLS services.
+var contentTypes = map[string]string{
+	".html":  "text/html",
+	".htm":   "text/html",
+	".css":   "text/css",
+	".csv":   "text/csv",
+	".md":    "text/markdown",
+	".txt":   "text/plain",
+	".js":    "text/javascript",
+	".mjs":   "text/javascript",
+	".json":  "application/json",
+	".xml":   "application/xml",
+	".yaml":  "application/yaml",
+	".yml":   "application/yaml",
+	".toml":  "application/toml",
+	".sh":    "application/x-sh",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".ico":   "image/x-icon",
+	".avif":  "image/avif",
+	".pdf":   "application/pdf",
+	".zip":   "application/zip",
+	".gz":    "application/gzip",
+	".tar":   "application/x-tar",
+	".wasm":  "application/wasm",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+
+	".ts":    "text/plain",
+	".tsx":   "text/plain",
+	".jsx":   "text/plain",
+	".rs":    "text/plain",
+	".go":    "text/plain",
+	".py":    "text/plain",
+	".rb":    "text/plain",
+	".java":  "text/plain",
+	".kt":    "text/plain",
+	".swift": "text/plain",
+	".c":     "text/plain",
+	".h":     "text/plain",
+	".cc":    "text/plain",
+	".cpp":   "text/plain",
+	".hpp":   "text/plain",
+	".cs":    "text/plain",
+	".php":   "text/plain",
+	".pl":    "text/plain",
+	".lua":   "text/plain",
+	".sql":   "text/plain",
+	".proto": "text/plain",
+	".vue":   "text/plain",
+	".scss":  "text/plain",
+}
+
+// detectContentType returns the media type of a file from the extension of
+// name, or from its first bytes when the extension isn't known, with the
+// charset of text files. Raw files are served like raw.githubusercontent.com
+// does, with every text type as text/plain. f is rewound afterwards.
+func detectContentType(name string, f io.ReadSeeker, raw bool) (string, error) {
+	sample := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	sample = sample[:n]
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	contentType, ok := contentTypes[strings.ToLower(path.Ext(name))]
+	if !ok {
+		contentType = http.DetectContentType(sample)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "application/octet-stream", nil
+	}
+
+	if !isText(mediaType) {
+		return mediaType, nil
+	}
+
+	if raw {
+		mediaType = "text/plain"
+	}
+
+	params := map[string]string{}
+	if charset := detectCharset(sample, n == sniffLength); charset != "" {
+		params["charset"] = charset
+	}
+
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+func isText(mediaType string) bool {
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/x-sh", "application/toml", "application/yaml":
+		return true
+	}
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+// detectCharset recognizes UTF-8 and, by their byte order marks, UTF-16
+// texts. Any other charset is left for the client to guess. A truncated sample
+// may end in the middle of a character, which is ignored.
+func detectCharset(sample []byte, truncated bool) string {
+	switch {
+	case len(sample) >= 2 && sample[0] == 0xfe && sample[1] == 0xff:
+		return "utf-16be"
+	case len(sample) >= 2 && sample[0] == 0xff && sample[1] == 0xfe:
+		return "utf-16le"
+	}
+
+	if truncated {
+		for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(sample[i]) {
+				if !utf8.FullRune(sample[i:]) {
+					sample = sample[:i]
+				}
+				break
+			}
+		}
+	}
+
+	if utf8.Valid(sample) {
+		return "utf-8"
+	}
+
+	return ""
+}
+
+// contentDisposition returns the Content-Disposition of a file served with
+// the disposition query parameter, which is empty, inline or attachment.
+func contentDisposition(disposition, name string) (string, bool) {
+	switch disposition {
+	case "":
+		return "", true
+	case "inline", "attachment":
+		return mime.FormatMediaType(disposition, map[string]string{"filename": name}), true
+	default:
+		return "", false
+	}
+}
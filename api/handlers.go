@@ -1,7 +1,13 @@
 package api
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/costinul/git-rest-cache/gitcache"
 	"github.com/costinul/git-rest-cache/provider"
@@ -31,13 +37,50 @@ func authMiddleware(gitCache *gitcache.GitCache, provider provider.Provider) gin
 			return
 		}
 
+		repo, err = sharedRepo(token, gitCache, repo)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			c.Abort()
+			return
+		}
+
+		if err := renewableURL(gitCache, repo); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			c.Abort()
+			return
+		}
+
+		providerName, repoPath := repo.Origin()
+		if err := gitCache.SetOrigin(repo.Hash(), repo.GitURL(), gitcache.Origin{Provider: providerName, Repo: repoPath}); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			c.Abort()
+			return
+		}
+
 		c.Set("repo", repo)
 		c.Next()
 	}
 }
 
 func getGitBlobHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
+	return fileHandler(gitCache, false)
+}
+
+// getGitRawHandler serves files like raw.githubusercontent.com, with text
+// files as text/plain.
+func getGitRawHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
+	return fileHandler(gitCache, true)
+}
+
+func fileHandler(gitCache *gitcache.GitCache, raw bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		name := path.Base(c.Param("filepath"))
+		disposition, ok := contentDisposition(c.Query("disposition"), name)
+		if !ok {
+			c.String(http.StatusBadRequest, "Invalid disposition, expected inline or attachment")
+			return
+		}
+
 		repo, exists := c.Get("repo")
 		if !exists {
 			c.String(http.StatusInternalServerError, "Repo not found in context")
@@ -50,17 +93,94 @@ func getGitBlobHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
 			return
 		}
 
-		data, err := gitCache.GetFileBlob(providerRepo.Hash(), providerRepo.GitURL(), c.Param("branch"), c.Param("filepath"))
+		info, err := gitCache.StatPath(c.Request.Context(), providerRepo.Hash(), providerRepo.GitURL(), c.Param("ref"), c.Param("filepath"))
 		if err != nil {
-			if err == gitcache.ErrFileNotFound {
+			if errors.Is(err, gitcache.ErrRefNotFound) {
+				c.String(http.StatusNotFound, "Ref not found")
+			} else {
+				c.String(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		setCacheHeaders(c, gitCache, providerRepo)
+		if notModified(c, info, "blob") {
+			return
+		}
+
+		f, opened, err := openBlob(c, gitCache, providerRepo, info)
+		if err != nil {
+			if errors.Is(err, gitcache.ErrRefNotFound) {
+				c.String(http.StatusNotFound, "Ref not found")
+			} else if err == gitcache.ErrFileNotFound {
 				c.String(http.StatusNotFound, "File not found")
 			} else {
 				c.String(http.StatusInternalServerError, err.Error())
 			}
 			return
 		}
+		defer f.Close()
 
-		c.Data(http.StatusOK, "application/octet-stream", data)
+		if opened.Hash != info.Hash {
+			info = opened
+			if notModified(c, info, "blob") {
+				return
+			}
+		}
+
+		contentType, err := detectContentType(name, f, raw)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Security-Policy", blobContentSecurityPolicy)
+		c.Header("X-Content-Type-Options", "nosniff")
+		if disposition != "" {
+			c.Header("Content-Disposition", disposition)
+		}
+
+		// ServeContent handles Range and If-Range against the ETag set
+		// above, and sets Content-Length.
+		http.ServeContent(c.Writer, c.Request, name, info.LastModified, f)
+	}
+}
+
+// maxOpenAttempts bounds how often openBlob reopens a file whose branch
+// keeps moving.
+const maxOpenAttempts = 3
+
+// openBlob opens the file and stats it again, so that the info returned
+// is that of the content opened, whose hash If-Range may splice ranges by.
+// While the branch moves, the file is reopened. If it doesn't settle, the
+// info is left empty and no validators are sent.
+func openBlob(c *gin.Context, gitCache *gitcache.GitCache, providerRepo provider.ProviderRepo, info gitcache.ObjectInfo) (io.ReadSeekCloser, gitcache.ObjectInfo, error) {
+	ctx := c.Request.Context()
+	for attempt := 1; ; attempt++ {
+		f, err := gitCache.OpenFile(ctx, providerRepo.Hash(), providerRepo.GitURL(), c.Param("ref"), c.Param("filepath"))
+		if err != nil {
+			return nil, gitcache.ObjectInfo{}, err
+		}
+
+		opened, err := gitCache.StatPath(ctx, providerRepo.Hash(), providerRepo.GitURL(), c.Param("ref"), c.Param("filepath"))
+		if err != nil {
+			f.Close()
+			return nil, gitcache.ObjectInfo{}, err
+		}
+
+		if opened.Hash == info.Hash {
+			return f, opened, nil
+		}
+
+		if attempt == maxOpenAttempts {
+			c.Writer.Header().Del("ETag")
+			c.Writer.Header().Del("Last-Modified")
+			return f, gitcache.ObjectInfo{}, nil
+		}
+
+		f.Close()
+		info = opened
 	}
 }
 
@@ -78,16 +198,248 @@ func getGitListHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
 			return
 		}
 
-		files, err := gitCache.ListDir(providerRepo.Hash(), providerRepo.GitURL(), c.Param("branch"), c.Param("path"))
+		query, err := parseListQuery(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		info, err := gitCache.StatPath(c.Request.Context(), providerRepo.Hash(), providerRepo.GitURL(), c.Param("ref"), c.Param("path"))
+		if err != nil {
+			if errors.Is(err, gitcache.ErrRefNotFound) {
+				c.String(http.StatusNotFound, "Ref not found")
+			} else {
+				c.String(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		setCacheHeaders(c, gitCache, providerRepo)
+		if notModified(c, info, "dir") {
+			return
+		}
+
+		// Pages are buffered to know whether another one follows, while
+		// whole NDJSON listings are streamed as they are read.
+		var files []gitcache.GitItem
+		var next string
+		stream := &ndjsonWriter{c: c}
+		err = gitCache.WalkDir(c.Request.Context(), providerRepo.Hash(), providerRepo.GitURL(), c.Param("ref"), c.Param("path"), query.options, func(item gitcache.GitItem) error {
+			if query.ndjson && query.limit == 0 {
+				return stream.write(item)
+			}
+
+			files = append(files, item)
+			if query.limit > 0 && len(files) > query.limit {
+				next = files[query.limit-1].Cursor()
+				files = files[:query.limit]
+				return fs.SkipAll
+			}
+			return nil
+		})
 		if err != nil {
-			if err == gitcache.ErrFileNotFound {
+			if stream.started() {
+				_ = c.Error(err)
+			} else if errors.Is(err, gitcache.ErrRefNotFound) {
+				c.String(http.StatusNotFound, "Ref not found")
+			} else if err == gitcache.ErrFileNotFound {
 				c.String(http.StatusNotFound, "Folder not found")
+			} else if err == gitcache.ErrInvalidCursor {
+				c.String(http.StatusBadRequest, "Invalid cursor")
+			} else {
+				c.String(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		if next != "" {
+			setNextPage(c, next)
+		}
+
+		if !query.ndjson {
+			c.JSON(http.StatusOK, files)
+			return
+		}
+
+		if !stream.started() {
+			stream.start()
+		}
+		for _, file := range files {
+			if err := stream.write(file); err != nil {
+				_ = c.Error(err)
+				return
+			}
+		}
+	}
+}
+
+func getGitLogHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo, exists := c.Get("repo")
+		if !exists {
+			c.String(http.StatusInternalServerError, "Repo not found in context")
+			return
+		}
+
+		providerRepo, ok := repo.(provider.ProviderRepo)
+		if !ok {
+			c.String(http.StatusInternalServerError, "Invalid repo type in context")
+			return
+		}
+
+		opts, err := parseLogQuery(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		history, err := gitCache.Log(c.Request.Context(), providerRepo.Hash(), providerRepo.GitURL(), c.Param("ref"), c.Param("path"), opts)
+		if err != nil {
+			if errors.Is(err, gitcache.ErrRefNotFound) {
+				c.String(http.StatusNotFound, "Ref not found")
+			} else if err == gitcache.ErrFileNotFound {
+				c.String(http.StatusNotFound, "Path not found")
 			} else {
 				c.String(http.StatusInternalServerError, err.Error())
 			}
 			return
 		}
 
-		c.JSON(http.StatusOK, files)
+		c.JSON(http.StatusOK, history)
+	}
+}
+
+// getGitCompareHandler compares two refs given as base...head, from their
+// merge base like GitHub's compare API. Refs can't contain "..", so the first
+// "..." splits them.
+func getGitCompareHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo, exists := c.Get("repo")
+		if !exists {
+			c.String(http.StatusInternalServerError, "Repo not found in context")
+			return
+		}
+
+		providerRepo, ok := repo.(provider.ProviderRepo)
+		if !ok {
+			c.String(http.StatusInternalServerError, "Invalid repo type in context")
+			return
+		}
+
+		base, head, ok := strings.Cut(strings.TrimPrefix(c.Param("basehead"), "/"), "...")
+		if !ok || base == "" || head == "" {
+			c.String(http.StatusBadRequest, "Invalid comparison, expected base...head")
+			return
+		}
+
+		patch := false
+		if value := c.Query("patch"); value != "" {
+			var err error
+			if patch, err = strconv.ParseBool(value); err != nil {
+				c.String(http.StatusBadRequest, "Invalid patch %q", value)
+				return
+			}
+		}
+
+		comparison, err := gitCache.Compare(c.Request.Context(), providerRepo.Hash(), providerRepo.GitURL(), base, head, patch)
+		if err != nil {
+			if errors.Is(err, gitcache.ErrRefNotFound) {
+				c.String(http.StatusNotFound, "Ref not found")
+			} else if err == gitcache.ErrNoMergeBase {
+				c.String(http.StatusUnprocessableEntity, "No common ancestor within max-history-depth commits")
+			} else {
+				c.String(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, comparison)
+	}
+}
+
+func getGitRefInfoHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo, exists := c.Get("repo")
+		if !exists {
+			c.String(http.StatusInternalServerError, "Repo not found in context")
+			return
+		}
+
+		providerRepo, ok := repo.(provider.ProviderRepo)
+		if !ok {
+			c.String(http.StatusInternalServerError, "Invalid repo type in context")
+			return
+		}
+
+		status, err := gitCache.RefStatus(c.Request.Context(), providerRepo.Hash(), providerRepo.GitURL(), c.Param("ref"))
+		if err != nil {
+			if errors.Is(err, gitcache.ErrRefNotFound) {
+				c.String(http.StatusNotFound, "Ref not found")
+			} else {
+				c.String(http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+func getStatsHandler(gitCache *gitcache.GitCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"blob_cache": gitCache.BlobCacheStats()})
+	}
+}
+
+// setCacheHeaders lets clients and proxies keep responses for tags and
+// commits indefinitely, since their content can never change.
+func setCacheHeaders(c *gin.Context, gitCache *gitcache.GitCache, repo provider.ProviderRepo) {
+	if !gitCache.IsImmutableRef(repo.Hash(), repo.GitURL(), c.Param("ref")) {
+		return
+	}
+
+	visibility := "public"
+	if c.GetHeader("X-Token") != "" {
+		visibility = "private"
+	}
+	c.Header("Cache-Control", visibility+", max-age=31536000, immutable")
+}
+
+// notModified sets the ETag and Last-Modified of the object when it is of
+// objectType, and answers 304 when the request's If-None-Match already has its
+// ETag. The ETag is the git object ID, which changes whenever the content does.
+func notModified(c *gin.Context, info gitcache.ObjectInfo, objectType string) bool {
+	if info.Type != objectType {
+		return false
+	}
+
+	if !info.LastModified.IsZero() {
+		c.Header("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if info.Hash == "" {
+		return false
+	}
+
+	etag := `"` + info.Hash + `"`
+	c.Header("ETag", etag)
+
+	if !etagMatches(c.GetHeader("If-None-Match"), etag) {
+		return false
+	}
+
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// etagMatches compares the tags of an If-None-Match header with etag, using
+// the weak comparison RFC 9110 requires for it.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/costinul/git-rest-cache/gitcache"
+	"github.com/gin-gonic/gin"
+)
+
+// maxListLimit bounds the page size of listings, whose pages are buffered to
+// know whether another one follows.
+const maxListLimit = 10000
+
+const ndjsonContentType = "application/x-ndjson"
+
+// listQuery holds the query parameters of a listing. A zero limit returns
+// every item at once.
+type listQuery struct {
+	options gitcache.ListOptions
+	limit   int
+	ndjson  bool
+}
+
+func parseListQuery(c *gin.Context) (listQuery, error) {
+	var query listQuery
+
+	if value := c.Query("recursive"); value != "" {
+		recursive, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, fmt.Errorf("invalid recursive %q", value)
+		}
+		query.options.Recursive = recursive
+	}
+
+	if value := c.Query("max_depth"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 {
+			return query, fmt.Errorf("invalid max_depth %q", value)
+		}
+		if !query.options.Recursive {
+			return query, fmt.Errorf("max_depth requires recursive=true")
+		}
+		query.options.MaxDepth = depth
+	}
+
+	query.options.Glob = c.Query("glob")
+	if _, err := path.Match(query.options.Glob, ""); err != nil {
+		return query, fmt.Errorf("invalid glob %q", query.options.Glob)
+	}
+
+	switch query.options.Type = c.Query("type"); query.options.Type {
+	case "", "blob", "dir":
+	default:
+		return query, fmt.Errorf("invalid type %q, expected blob or dir", query.options.Type)
+	}
+
+	query.options.After = c.Query("cursor")
+
+	if value := c.Query("sizes"); value != "" {
+		sizes, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, fmt.Errorf("invalid sizes %q", value)
+		}
+		query.options.OmitSizes = !sizes
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return query, fmt.Errorf("invalid limit %q, expected 1 to %d", value, maxListLimit)
+		}
+		query.limit = limit
+	}
+
+	switch format := c.Query("format"); format {
+	case "", "json":
+	case "ndjson":
+		query.ndjson = true
+	default:
+		return query, fmt.Errorf("invalid format %q, expected json or ndjson", format)
+	}
+
+	return query, nil
+}
+
+// setNextPage points the Link header to the page after cursor.
+func setNextPage(c *gin.Context, cursor string) {
+	next := *c.Request.URL
+	values := next.Query()
+	values.Set("cursor", cursor)
+	next.RawQuery = values.Encode()
+
+	c.Header("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+}
+
+// ndjsonWriter writes items as newline-delimited JSON, sending the headers
+// with the first item so that errors before it can still be reported.
+type ndjsonWriter struct {
+	c       *gin.Context
+	encoder *json.Encoder
+}
+
+func (w *ndjsonWriter) write(item gitcache.GitItem) error {
+	if w.encoder == nil {
+		w.start()
+	}
+	return w.encoder.Encode(item)
+}
+
+func (w *ndjsonWriter) start() {
+	w.c.Header("Content-Type", ndjsonContentType)
+	w.c.Status(http.StatusOK)
+	w.encoder = json.NewEncoder(w.c.Writer)
+}
+
+func (w *ndjsonWriter) started() bool {
+	return w.encoder != nil
+}
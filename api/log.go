@@ -0,0 +1,44 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/costinul/git-rest-cache/gitcache"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLogLimit = 30
+	maxLogLimit     = 1000
+)
+
+func parseLogQuery(c *gin.Context) (gitcache.LogOptions, error) {
+	opts := gitcache.LogOptions{Limit: defaultLogLimit}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLogLimit {
+			return opts, fmt.Errorf("invalid limit %q, expected 1 to %d", value, maxLogLimit)
+		}
+		opts.Limit = limit
+	}
+
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &opts.Since}, {"until", &opts.Until}} {
+		value := c.Query(bound.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q, expected an RFC 3339 date", bound.name, value)
+		}
+		*bound.value = t
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/costinul/git-rest-cache/gitcache"
+	"github.com/gin-gonic/gin"
+)
+
+// maxWebhookBody bounds the payloads read by the webhook endpoints. Push
+// events of GitHub are capped at 25 MB.
+const maxWebhookBody = 25 << 20
+
+// zeroSHA is the commit a deleted branch points to in GitLab push events.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// pushEvent is a push to one or more branches of a repo. remotes holds the
+// URLs the repo can be cloned from.
+type pushEvent struct {
+	remotes  []string
+	branches []string
+}
+
+type webhook struct {
+	path   string
+	verify func(c *gin.Context, secret string, body []byte) bool
+	parse  func(c *gin.Context, body []byte) (*pushEvent, error)
+}
+
+var webhooks = []webhook{
+	{"/webhooks/github", verifyHubSignature("X-Hub-Signature-256"), parseGithubPush},
+	{"/webhooks/gitlab", verifyGitlabToken, parseGitlabPush},
+	{"/webhooks/bitbucket", verifyHubSignature("X-Hub-Signature"), parseBitbucketPush},
+}
+
+func registerWebhooks(router *gin.Engine, gitCache *gitcache.GitCache, secret string) {
+	for _, w := range webhooks {
+		router.POST(w.path, webhookHandler(gitCache, secret, w))
+	}
+}
+
+func webhookHandler(gitCache *gitcache.GitCache, secret string, w webhook) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBody))
+		if err != nil {
+			c.String(http.StatusRequestEntityTooLarge, "Payload too large")
+			return
+		}
+
+		if !w.verify(c, secret, body) {
+			c.String(http.StatusUnauthorized, "Invalid signature")
+			return
+		}
+
+		event, err := w.parse(c, body)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		scheduled := 0
+		if event != nil {
+			for _, branch := range event.branches {
+				scheduled += gitCache.RefreshBranch(event.remotes, branch)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"scheduled": scheduled})
+	}
+}
+
+// verifyHubSignature checks the HMAC-SHA256 signature of the body that GitHub
+// and Bitbucket send as "sha256=<hex>" in header.
+func verifyHubSignature(header string) func(c *gin.Context, secret string, body []byte) bool {
+	return func(c *gin.Context, secret string, body []byte) bool {
+		signature, ok := strings.CutPrefix(c.GetHeader(header), "sha256=")
+		if !ok {
+			return false
+		}
+
+		received, err := hex.DecodeString(signature)
+		if err != nil {
+			return false
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		return hmac.Equal(received, mac.Sum(nil))
+	}
+}
+
+// verifyGitlabToken checks the secret token, which GitLab sends as is rather
+// than signing the body.
+func verifyGitlabToken(c *gin.Context, secret string, body []byte) bool {
+	return subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Gitlab-Token")), []byte(secret)) == 1
+}
+
+func parseGithubPush(c *gin.Context, body []byte) (*pushEvent, error) {
+	if c.GetHeader("X-GitHub-Event") != "push" {
+		return nil, nil
+	}
+
+	var payload struct {
+		Ref        string `json:"ref"`
+		Deleted    bool   `json:"deleted"`
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+			SSHURL   string `json:"ssh_url"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid push event: %w", err)
+	}
+
+	branch, ok := strings.CutPrefix(payload.Ref, "refs/heads/")
+	if !ok || payload.Deleted {
+		return nil, nil
+	}
+
+	return &pushEvent{
+		remotes:  []string{payload.Repository.CloneURL, payload.Repository.SSHURL},
+		branches: []string{branch},
+	}, nil
+}
+
+func parseGitlabPush(c *gin.Context, body []byte) (*pushEvent, error) {
+	if c.GetHeader("X-Gitlab-Event") != "Push Hook" {
+		return nil, nil
+	}
+
+	var payload struct {
+		Ref     string `json:"ref"`
+		After   string `json:"after"`
+		Project struct {
+			HTTPURL string `json:"git_http_url"`
+			SSHURL  string `json:"git_ssh_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid push event: %w", err)
+	}
+
+	branch, ok := strings.CutPrefix(payload.Ref, "refs/heads/")
+	if !ok || payload.After == zeroSHA {
+		return nil, nil
+	}
+
+	return &pushEvent{
+		remotes:  []string{payload.Project.HTTPURL, payload.Project.SSHURL},
+		branches: []string{branch},
+	}, nil
+}
+
+// parseBitbucketPush handles both the repo:push events of Bitbucket Cloud and
+// the repo:refs_changed events of Bitbucket Server.
+func parseBitbucketPush(c *gin.Context, body []byte) (*pushEvent, error) {
+	var payload struct {
+		Repository struct {
+			Links struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+				Clone []struct {
+					Href string `json:"href"`
+				} `json:"clone"`
+			} `json:"links"`
+		} `json:"repository"`
+		Push struct {
+			Changes []struct {
+				New *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+		Changes []struct {
+			Ref struct {
+				ID string `json:"id"`
+			} `json:"ref"`
+			Type string `json:"type"`
+		} `json:"changes"`
+	}
+
+	switch c.GetHeader("X-Event-Key") {
+	case "repo:push", "repo:refs_changed":
+	default:
+		return nil, nil
+	}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid push event: %w", err)
+	}
+
+	event := &pushEvent{}
+	if href := payload.Repository.Links.HTML.Href; href != "" {
+		event.remotes = append(event.remotes, href)
+	}
+	for _, link := range payload.Repository.Links.Clone {
+		event.remotes = append(event.remotes, link.Href)
+	}
+
+	for _, change := range payload.Push.Changes {
+		if change.New != nil && change.New.Type == "branch" {
+			event.branches = append(event.branches, change.New.Name)
+		}
+	}
+	for _, change := range payload.Changes {
+		if branch, ok := strings.CutPrefix(change.Ref.ID, "refs/heads/"); ok && change.Type != "DELETE" {
+			event.branches = append(event.branches, branch)
+		}
+	}
+
+	return event, nil
+}
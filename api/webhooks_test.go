@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/costinul/git-rest-cache/gitcache"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	secret := "webhook-secret"
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           10 * time.Minute,
+		RepoCheckInterval: 1 * time.Minute,
+		WebhookSecret:     secret,
+		WebhookDebounce:   50 * time.Millisecond,
+	}
+
+	var mu sync.Mutex
+	updates := map[string]int{}
+	gitManager := gitcache.NewTestGitManager(readFile, listTree)
+	gitManager.UpdateBranchCallback = func(gitUrl, branch string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		updates[gitUrl+"#"+branch]++
+		return nil
+	}
+	countUpdates := func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		counts := map[string]int{}
+		for key, count := range updates {
+			counts[key] = count
+		}
+		return counts
+	}
+
+	gitCache := gitcache.NewGitCache(cfg, context.Background(), gitManager)
+	router := NewCacheAPI(cfg, gitCache, newMockProviderManager()).Router()
+
+	cached := []struct{ hash, gitUrl, branch string }{
+		{"public", "https://github.com/acme/tools.git", "main"},
+		{"private", "https://token@github.com/acme/tools.git", "main"},
+		{"ssh", "git@gitlab.com:group/sub/repo.git", "main"},
+		{"server", "https://bitbucket.example.com/scm/prj/widgets.git", "develop"},
+	}
+	for _, c := range cached {
+		_, err := gitCache.GetFileBlob(context.Background(), c.hash, c.gitUrl, c.branch, "file.txt")
+		require.NoError(t, err)
+	}
+
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	githubPush := `{"ref":"refs/heads/main","repository":{"clone_url":"https://github.com/Acme/tools.git","ssh_url":"git@github.com:Acme/tools.git"}}`
+	gitlabPush := `{"ref":"refs/heads/main","after":"1111111111111111111111111111111111111111","project":{"git_http_url":"https://gitlab.com/group/sub/repo.git","git_ssh_url":"git@gitlab.com:group/sub/repo.git"}}`
+	bitbucketPush := `{"repository":{"links":{"clone":[{"href":"https://bitbucket.example.com/scm/prj/widgets.git"}]}},"changes":[{"ref":{"id":"refs/heads/develop"},"type":"UPDATE"}]}`
+
+	tests := []struct {
+		name          string
+		path          string
+		body          string
+		headers       map[string]string
+		wantStatus    int
+		wantScheduled string
+	}{
+		{
+			name:          "GitHub push refreshes every clone of the repo",
+			path:          "/webhooks/github",
+			body:          githubPush,
+			headers:       map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": sign(githubPush)},
+			wantStatus:    http.StatusAccepted,
+			wantScheduled: `{"scheduled":2}`,
+		},
+		{
+			name:       "GitHub push with an invalid signature",
+			path:       "/webhooks/github",
+			body:       githubPush,
+			headers:    map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": sign("other")},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "GitHub ping",
+			path:          "/webhooks/github",
+			body:          `{"zen":"hi"}`,
+			headers:       map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": sign(`{"zen":"hi"}`)},
+			wantStatus:    http.StatusAccepted,
+			wantScheduled: `{"scheduled":0}`,
+		},
+		{
+			name:          "GitLab push",
+			path:          "/webhooks/gitlab",
+			body:          gitlabPush,
+			headers:       map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": secret},
+			wantStatus:    http.StatusAccepted,
+			wantScheduled: `{"scheduled":1}`,
+		},
+		{
+			name:       "GitLab push with an invalid token",
+			path:       "/webhooks/gitlab",
+			body:       gitlabPush,
+			headers:    map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "Bitbucket Server push",
+			path:          "/webhooks/bitbucket",
+			body:          bitbucketPush,
+			headers:       map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": sign(bitbucketPush)},
+			wantStatus:    http.StatusAccepted,
+			wantScheduled: `{"scheduled":1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantScheduled != "" {
+				assert.Equal(t, tt.wantScheduled, w.Body.String())
+			}
+		})
+	}
+
+	assert.Eventually(t, func() bool { return len(countUpdates()) == 4 }, time.Second, 10*time.Millisecond)
+
+	// A burst of pushes is coalesced into a single update.
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/webhooks/github", strings.NewReader(githubPush))
+		require.NoError(t, err)
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", sign(githubPush))
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	assert.Eventually(t, func() bool {
+		return countUpdates()["https://github.com/acme/tools.git#main"] == 2
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(3 * cfg.WebhookDebounce)
+	assert.Equal(t, map[string]int{
+		"https://github.com/acme/tools.git#main":                    2,
+		"https://token@github.com/acme/tools.git#main":              2,
+		"git@gitlab.com:group/sub/repo.git#main":                    1,
+		"https://bitbucket.example.com/scm/prj/widgets.git#develop": 1,
+	}, countUpdates())
+}
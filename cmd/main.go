@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/costinul/git-rest-cache/api"
 	"github.com/costinul/git-rest-cache/config"
@@ -38,14 +40,36 @@ func startApp() {
 	logger.Info("Starting app...")
 	ctx := context.Background()
 
-	gitCache := gitcache.NewGitCache(cfg, ctx, &gitcache.DefaultGitManager{})
-	err := gitCache.Start()
+	gitManager, err := gitcache.NewGitCacheManager(cfg.StorageMode)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to create git manager: %v", err))
+		os.Exit(1)
+	}
+
+	gitCache := gitcache.NewGitCache(cfg, ctx, gitManager)
+	err = gitCache.Start()
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to start git cache: %v", err))
 		os.Exit(1)
 	}
 
-	providerManager := provider.NewDefaultProviderManager()
+	// Stopping the cache saves its index, so access times survive restarts.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		logger.Info("Stopping app...")
+		gitCache.Stop()
+		os.Exit(0)
+	}()
+
+	providerManager, err := provider.NewDefaultProviderManager(cfg)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to create providers: %v", err))
+		os.Exit(1)
+	}
+
 	api := api.NewCacheAPI(cfg, gitCache, providerManager)
 	err = api.Run()
 	if err != nil {
@@ -12,12 +12,97 @@ import (
 )
 
 type Config struct {
-	Port              int           `mapstructure:"port"`
-	LogLevel          string        `mapstructure:"log-level"`
-	StorageFolder     string        `mapstructure:"storage-folder"`
-	RepoTTL           time.Duration `mapstructure:"repo-ttl"`
-	TokenTTL          time.Duration `mapstructure:"token-ttl"`
-	RepoCheckInterval time.Duration `mapstructure:"repo-check-interval"`
+	Port                int              `mapstructure:"port"`
+	LogLevel            string           `mapstructure:"log-level"`
+	StorageFolder       string           `mapstructure:"storage-folder"`
+	RepoTTL             time.Duration    `mapstructure:"repo-ttl"`
+	TokenTTL            time.Duration    `mapstructure:"token-ttl"`
+	RepoCheckInterval   time.Duration    `mapstructure:"repo-check-interval"`
+	StorageMode         string           `mapstructure:"storage-mode"`
+	GitlabURL           string           `mapstructure:"gitlab-url"`
+	BitbucketServerURL  string           `mapstructure:"bitbucket-server-url"`
+	GitHosts            []GitHost        `mapstructure:"git-hosts"`
+	GithubInstances     []GithubInstance `mapstructure:"github-instances"`
+	SSHKeys             []SSHKey         `mapstructure:"ssh-keys"`
+	SSHKnownHosts       string           `mapstructure:"ssh-known-hosts"`
+	SSHCommand          string           `mapstructure:"ssh-command"`
+	WebhookSecret       string           `mapstructure:"webhook-secret"`
+	WebhookDebounce     time.Duration    `mapstructure:"webhook-debounce"`
+	UpdateWorkers       int              `mapstructure:"update-workers"`
+	UpdateTimeout       time.Duration    `mapstructure:"update-timeout"`
+	UpdateMaxBackoff    time.Duration    `mapstructure:"update-max-backoff"`
+	MaxConcurrentClones int              `mapstructure:"max-concurrent-clones"`
+	MaxStorageBytes     int64            `mapstructure:"max-storage-bytes"`
+	BlobCacheBytes      int64            `mapstructure:"blob-cache-bytes"`
+	BlobCacheMaxObject  int64            `mapstructure:"blob-cache-max-object"`
+	MaxHistoryDepth     int              `mapstructure:"max-history-depth"`
+}
+
+// SSHKey maps the repos on a host to the deploy key they are cloned with.
+// Path is an owner or namespace, a single repo, or empty for the whole host.
+type SSHKey struct {
+	Host string `mapstructure:"host"`
+	Path string `mapstructure:"path"`
+	Key  string `mapstructure:"key"`
+	User string `mapstructure:"user"`
+}
+
+// SSHKeyFor returns the most specific deploy key configured for a repo.
+func (c *Config) SSHKeyFor(host, repoPath string) (SSHKey, bool) {
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+
+	var found SSHKey
+	matched := -1
+	for _, key := range c.SSHKeys {
+		if !strings.EqualFold(key.Host, host) {
+			continue
+		}
+
+		keyPath := strings.TrimSuffix(strings.Trim(key.Path, "/"), ".git")
+		if keyPath != "" && keyPath != repoPath && !strings.HasPrefix(repoPath, keyPath+"/") {
+			continue
+		}
+
+		if len(keyPath) > matched {
+			found = key
+			matched = len(keyPath)
+		}
+	}
+
+	if matched < 0 {
+		return SSHKey{}, false
+	}
+
+	if found.User == "" {
+		found.User = "git"
+	}
+
+	return found, true
+}
+
+// GithubInstance declares a GitHub Enterprise Server, or overrides the
+// settings of github.com when named "github".
+type GithubInstance struct {
+	Name     string `mapstructure:"name"`
+	APIURL   string `mapstructure:"api-url"`
+	CloneURL string `mapstructure:"clone-url"`
+	Route    string `mapstructure:"route"`
+	CABundle string `mapstructure:"ca-bundle"`
+
+	// AppID and AppPrivateKey, the path of the app's PEM key, make the
+	// instance authenticate as a GitHub App. Callers then present one of the
+	// ClientKeys instead of GitHub credentials.
+	AppID         int64    `mapstructure:"app-id"`
+	AppPrivateKey string   `mapstructure:"app-private-key"`
+	ClientKeys    []string `mapstructure:"client-keys"`
+}
+
+// GitHost declares a plain git-over-HTTP(S) server, served under /git/<name>.
+type GitHost struct {
+	Name     string `mapstructure:"name"`
+	URL      string `mapstructure:"url"`
+	Auth     string `mapstructure:"auth"`
+	Username string `mapstructure:"username"`
 }
 
 var cfg Config
@@ -33,6 +118,21 @@ func InitConfig(cmd *cobra.Command) {
 	viper.SetDefault("repo-ttl", "24h")
 	viper.SetDefault("token-ttl", "24h")
 	viper.SetDefault("repo-check-interval", "5m")
+	viper.SetDefault("storage-mode", "worktree")
+	viper.SetDefault("gitlab-url", "https://gitlab.com")
+	viper.SetDefault("bitbucket-server-url", "")
+	viper.SetDefault("ssh-known-hosts", "")
+	viper.SetDefault("ssh-command", "ssh")
+	viper.SetDefault("webhook-secret", "")
+	viper.SetDefault("webhook-debounce", "2s")
+	viper.SetDefault("update-workers", 4)
+	viper.SetDefault("update-timeout", "2m")
+	viper.SetDefault("update-max-backoff", "1h")
+	viper.SetDefault("max-concurrent-clones", 4)
+	viper.SetDefault("max-storage-bytes", 0)
+	viper.SetDefault("blob-cache-bytes", 64<<20)
+	viper.SetDefault("blob-cache-max-object", 1<<20)
+	viper.SetDefault("max-history-depth", 1000)
 
 	if viper.ConfigFileUsed() == "" {
 		viper.SetConfigName("config")
@@ -59,6 +159,21 @@ func InitConfig(cmd *cobra.Command) {
 	cmd.PersistentFlags().String("repo-ttl", "24h", "Time a repo remains in cache since last access")
 	cmd.PersistentFlags().String("token-ttl", "24h", "Time a token remains valid in memory after last use")
 	cmd.PersistentFlags().String("repo-check-interval", "5m", "Interval to fetch changes in cached repos")
+	cmd.PersistentFlags().String("storage-mode", "worktree", "How repos are stored (worktree, object-store)")
+	cmd.PersistentFlags().String("gitlab-url", "https://gitlab.com", "Base URL of the GitLab instance")
+	cmd.PersistentFlags().String("bitbucket-server-url", "", "Base URL of the Bitbucket Server/Data Center instance (disabled when empty)")
+	cmd.PersistentFlags().String("ssh-known-hosts", "", "known_hosts file the hosts of SSH remotes are verified against (required with ssh-keys)")
+	cmd.PersistentFlags().String("ssh-command", "ssh", "SSH client used for SSH remotes")
+	cmd.PersistentFlags().String("webhook-secret", "", "Secret of the push webhooks (webhooks are disabled when empty)")
+	cmd.PersistentFlags().String("webhook-debounce", "2s", "Time to wait for further pushes before updating a branch")
+	cmd.PersistentFlags().Int("update-workers", 4, "Number of repos updated in parallel")
+	cmd.PersistentFlags().String("update-timeout", "2m", "Time limit of a single fetch of a cached ref")
+	cmd.PersistentFlags().String("update-max-backoff", "1h", "Maximum wait before retrying a repo that keeps failing to update")
+	cmd.PersistentFlags().Int("max-concurrent-clones", 4, "Maximum number of refs cloned at the same time (unlimited when 0)")
+	cmd.PersistentFlags().Int64("max-storage-bytes", 0, "Disk budget of the cached repos, enforced by evicting the least recently read refs (unlimited when 0)")
+	cmd.PersistentFlags().Int64("blob-cache-bytes", 64<<20, "Memory used to keep the contents of frequently read files (disabled when 0)")
+	cmd.PersistentFlags().Int64("blob-cache-max-object", 1<<20, "Largest file kept in the blob cache")
+	cmd.PersistentFlags().Int("max-history-depth", 1000, "Number of commits a clone is deepened to on demand to serve history (no deepening when 0)")
 
 	cmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
 		_ = viper.BindPFlag(f.Name, f)
@@ -60,3 +60,42 @@ storage-folder: "/from-yaml"
 		t.Errorf("Expected storage-folder=/from-env from ENV override, got %s", c.StorageFolder)
 	}
 }
+
+func TestSSHKeyFor(t *testing.T) {
+	c := &Config{
+		SSHKeys: []SSHKey{
+			{Host: "github.com", Key: "/keys/host"},
+			{Host: "github.com", Path: "acme", Key: "/keys/acme"},
+			{Host: "github.com", Path: "acme/tools.git", Key: "/keys/tools", User: "deploy"},
+			{Host: "gitlab.com", Path: "group/sub", Key: "/keys/sub"},
+		},
+	}
+
+	tests := []struct {
+		host     string
+		repoPath string
+		wantKey  string
+		wantUser string
+	}{
+		{host: "github.com", repoPath: "other/repo", wantKey: "/keys/host", wantUser: "git"},
+		{host: "GitHub.com", repoPath: "acme/widgets.git", wantKey: "/keys/acme", wantUser: "git"},
+		{host: "github.com", repoPath: "acme/tools", wantKey: "/keys/tools", wantUser: "deploy"},
+		{host: "github.com", repoPath: "acme-other/tools", wantKey: "/keys/host", wantUser: "git"},
+		{host: "gitlab.com", repoPath: "group/sub/deep/repo.git", wantKey: "/keys/sub", wantUser: "git"},
+		{host: "gitlab.com", repoPath: "group/subway/repo", wantKey: ""},
+		{host: "bitbucket.org", repoPath: "acme/tools", wantKey: ""},
+	}
+
+	for _, tt := range tests {
+		key, ok := c.SSHKeyFor(tt.host, tt.repoPath)
+		if tt.wantKey == "" {
+			if ok {
+				t.Errorf("%s/%s: expected no key, got %s", tt.host, tt.repoPath, key.Key)
+			}
+			continue
+		}
+		if !ok || key.Key != tt.wantKey || key.User != tt.wantUser {
+			t.Errorf("%s/%s: expected %s@%s, got %s@%s (found=%v)", tt.host, tt.repoPath, tt.wantUser, tt.wantKey, key.User, key.Key, ok)
+		}
+	}
+}
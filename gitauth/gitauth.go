@@ -0,0 +1,102 @@
+// Package gitauth keeps the credentials that providers embed in git URLs away
+// from git's own configuration. The URL handed to git is stripped of them, and
+// they are passed as an http.extraHeader through the environment of each
+// invocation, so they are never written into a clone's .git/config.
+package gitauth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// BearerTokenUser is the username of git URLs whose password is a token to
+// send as a bearer token rather than with basic auth, like the HTTP access
+// tokens of Bitbucket Server.
+const BearerTokenUser = "x-bearer-token"
+
+// Setting is git configuration passed through the environment.
+type Setting struct {
+	Key   string
+	Value string
+}
+
+// Credentials are those of a git URL. URL is the git URL without them, and
+// Header the Authorization header that carries them, empty when the URL has
+// none.
+type Credentials struct {
+	URL     string
+	Header  string
+	secrets []string
+}
+
+// FromURL takes the credentials out of gitUrl.
+func FromURL(gitUrl string) Credentials {
+	u, err := url.Parse(gitUrl)
+	if err != nil || u.User == nil {
+		return Credentials{URL: gitUrl}
+	}
+
+	username := u.User.Username()
+	password, _ := u.User.Password()
+	u.User = nil
+
+	if username == BearerTokenUser {
+		return Credentials{
+			URL:     u.String(),
+			Header:  "Authorization: Bearer " + password,
+			secrets: []string{password},
+		}
+	}
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+
+	c := Credentials{
+		URL:     u.String(),
+		Header:  "Authorization: Basic " + encoded,
+		secrets: []string{encoded},
+	}
+	for _, secret := range []string{username, password} {
+		if secret != "" {
+			c.secrets = append(c.secrets, secret)
+		}
+	}
+
+	return c
+}
+
+// Command returns a git command that sends the credentials, along with the
+// settings, and never prompts for others.
+func (c Credentials) Command(ctx context.Context, settings []Setting, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if c.Header != "" {
+		settings = append([]Setting{{"http.extraHeader", c.Header}}, settings...)
+	}
+
+	if len(settings) > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(settings)))
+		for i, setting := range settings {
+			cmd.Env = append(cmd.Env,
+				fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, setting.Key),
+				fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, setting.Value),
+			)
+		}
+	}
+
+	return cmd
+}
+
+// Redact masks the credentials in the output of git.
+func (c Credentials) Redact(output []byte) string {
+	text := string(output)
+	for _, secret := range c.secrets {
+		text = strings.ReplaceAll(text, secret, "***")
+	}
+	return text
+}
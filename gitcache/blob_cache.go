@@ -0,0 +1,129 @@
+package gitcache
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// BlobCacheStats reports the use of the in-memory blob cache.
+type BlobCacheStats struct {
+	Enabled  bool  `json:"enabled"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Entries  int   `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// blobCache keeps the contents of recently read blobs in memory, keyed by
+// object ID. Blobs never change, so entries never go stale, and a blob shared
+// by several refs or repos is kept once. Cached contents are shared between
+// callers, which must not modify them.
+type blobCache struct {
+	maxBytes  int64
+	maxObject int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	bytes   int64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type blobEntry struct {
+	id      string
+	content []byte
+}
+
+func newBlobCache(maxBytes, maxObject int64) *blobCache {
+	if maxObject <= 0 || maxObject > maxBytes {
+		maxObject = maxBytes
+	}
+
+	return &blobCache{
+		maxBytes:  maxBytes,
+		maxObject: maxObject,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+func (c *blobCache) get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[id]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	c.lru.MoveToFront(element)
+	return element.Value.(*blobEntry).content, true
+}
+
+// add caches content as blob id, evicting the least recently read blobs to
+// make room. Blobs larger than the max object size are not cached.
+func (c *blobCache) add(id string, content []byte) {
+	size := int64(len(content))
+	if size > c.maxObject {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[id]; ok {
+		return
+	}
+
+	for c.bytes+size > c.maxBytes {
+		oldest := c.lru.Back()
+		entry := c.lru.Remove(oldest).(*blobEntry)
+		delete(c.entries, entry.id)
+		c.bytes -= int64(len(entry.content))
+	}
+
+	c.entries[id] = c.lru.PushFront(&blobEntry{id: id, content: content})
+	c.bytes += size
+}
+
+func (c *blobCache) stats() BlobCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return BlobCacheStats{
+		Enabled:  true,
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Entries:  len(c.entries),
+		Bytes:    c.bytes,
+		MaxBytes: c.maxBytes,
+	}
+}
+
+// blobObjectID hashes content the way git does, with SHA-256 for 64
+// character IDs and SHA-1 otherwise, so that what is read from disk can be
+// checked against the ID it is cached under.
+func blobObjectID(content []byte, idLength int) string {
+	var h hash.Hash
+	if idLength == sha256.Size*2 {
+		h = sha256.New()
+	} else {
+		h = sha1.New()
+	}
+
+	h.Write([]byte("blob " + strconv.Itoa(len(content)) + "\x00"))
+	h.Write(content)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
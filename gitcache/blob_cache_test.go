@@ -0,0 +1,80 @@
+package gitcache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobCacheEviction(t *testing.T) {
+	cache := newBlobCache(10, 4)
+
+	cache.add("a", []byte("aaaa"))
+	cache.add("b", []byte("bbbb"))
+	cache.add("big", []byte("too large"))
+
+	_, ok := cache.get("big")
+	assert.False(t, ok, "blobs over the max object size should not be cached")
+
+	_, ok = cache.get("a")
+	require.True(t, ok)
+
+	cache.add("c", []byte("cccc"))
+	_, ok = cache.get("b")
+	assert.False(t, ok, "the least recently read blob should be evicted")
+
+	content, ok := cache.get("a")
+	require.True(t, ok)
+	assert.Equal(t, "aaaa", string(content))
+
+	assert.Equal(t, BlobCacheStats{Enabled: true, Hits: 2, Misses: 2, Entries: 2, Bytes: 8, MaxBytes: 10}, cache.stats())
+}
+
+func TestBlobObjectID(t *testing.T) {
+	// git hash-object of "hello\n", in SHA-1 and SHA-256 repos.
+	assert.Equal(t, "ce013625030ba8dba906f756967f9e9ca394464a", blobObjectID([]byte("hello\n"), 40))
+	assert.Equal(t, "2cf8d83d9ee29543b34a87727421fdecb7e3f3a183d337639025de576db9ebb4", blobObjectID([]byte("hello\n"), 64))
+}
+
+func TestBlobCacheSharedAcrossRepos(t *testing.T) {
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           time.Hour,
+		RepoCheckInterval: time.Minute,
+		BlobCacheBytes:    1 << 20,
+	}
+	cache := NewGitCache(cfg, context.Background(), &DefaultGitManager{})
+
+	first := newTestRemote(t)
+	first.commit("docs/shared.txt", "shared")
+	second := newTestRemote(t)
+	second.commit("shared.txt", "shared")
+
+	read := func(hash string, remote *testRemote, filePath string) string {
+		content, err := cache.GetFileBlob(context.Background(), hash, remote.url, "main", filePath)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	assert.Equal(t, "shared", read("first", first, "/docs/shared.txt"))
+	assert.Equal(t, "shared", read("second", second, "/shared.txt"))
+	assert.Equal(t, BlobCacheStats{Enabled: true, Hits: 1, Misses: 1, Entries: 1, Bytes: 6, MaxBytes: 1 << 20}, cache.BlobCacheStats())
+
+	// Hits are served from memory.
+	checkout := filepath.Join(cfg.StorageFolder, "first", "main", "docs", "shared.txt")
+	require.NoError(t, os.WriteFile(checkout, []byte("changed on disk"), 0644))
+	assert.Equal(t, "shared", read("first", first, "/docs/shared.txt"))
+
+	// A branch that moves reads its files again.
+	first.commit("docs/shared.txt", "updated")
+	require.NoError(t, cache.checkRepos())
+	assert.Equal(t, "updated", read("first", first, "/docs/shared.txt"))
+	assert.Equal(t, "updated", read("first", first, "/docs/shared.txt"))
+	assert.Equal(t, int64(3), cache.BlobCacheStats().Hits)
+}
@@ -0,0 +1,224 @@
+package gitcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+var ErrNoMergeBase = fmt.Errorf("no common ancestor")
+
+// FileChange is a path that differs between two commits. Status is added,
+// modified, deleted or renamed, and OldPath the path a renamed file had.
+// Patch, when asked for, is the file's part of the unified diff.
+type FileChange struct {
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+	Status  string `json:"status"`
+	Patch   string `json:"patch,omitempty"`
+}
+
+// Comparison lists the changes head made since it forked from base, that is
+// from their merge base to head, like a three-dot git diff.
+type Comparison struct {
+	BaseCommit      string       `json:"base_commit"`
+	HeadCommit      string       `json:"head_commit"`
+	MergeBaseCommit string       `json:"merge_base_commit"`
+	Files           []FileChange `json:"files"`
+}
+
+// diffStatuses maps the status letters of git's raw diff format. A change of
+// type, e.g. from a file to a symlink, is reported as a modification.
+var diffStatuses = map[byte]string{
+	'A': "added",
+	'M': "modified",
+	'T': "modified",
+	'D': "deleted",
+	'R': "renamed",
+}
+
+// Compare returns the files that changed from the merge base of the commits
+// base and head are cached at to the commit head is cached at. Both refs are
+// cached like any other ref, and share the object store of the repo.
+func (c *GitCache) Compare(ctx context.Context, hash, gitUrl, base, head string, patch bool) (Comparison, error) {
+	var branches []*gitBranch
+	defer func() {
+		for _, b := range branches {
+			b.release()
+		}
+	}()
+
+	for _, ref := range []string{base, head} {
+		b, err := c.acquireBranch(hash, gitUrl, ref)
+		if err != nil {
+			return Comparison{}, err
+		}
+		branches = append(branches, b)
+
+		if err := b.cache(ctx); err != nil {
+			return Comparison{}, err
+		}
+	}
+
+	baseBranch, headBranch := branches[0], branches[1]
+	headBranch.repo.rmu.RLock()
+	comparison := Comparison{BaseCommit: baseBranch.sha, HeadCommit: headBranch.sha}
+	headBranch.repo.rmu.RUnlock()
+
+	mergeBase, err := findMergeBase(ctx, baseBranch, headBranch, comparison.BaseCommit, comparison.HeadCommit)
+	if err != nil {
+		return Comparison{}, err
+	}
+	comparison.MergeBaseCommit = mergeBase
+
+	files, err := c.manager.diff(headBranch, mergeBase, comparison.HeadCommit, patch)
+	if err != nil {
+		return Comparison{}, err
+	}
+	comparison.Files = files
+
+	for _, b := range branches {
+		b.touch()
+	}
+
+	return comparison, nil
+}
+
+// findMergeBase deepens the history of both refs until it meets, like log
+// does, up to max-history-depth commits each.
+func findMergeBase(ctx context.Context, base, head *gitBranch, baseCommit, headCommit string) (string, error) {
+	manager := head.repo.cache.manager
+	maxDepth := head.repo.cache.cfg.MaxHistoryDepth
+	sides := []struct {
+		branch *gitBranch
+		commit string
+	}{{base, baseCommit}, {head, headCommit}}
+
+	for {
+		mergeBase, found, err := manager.mergeBase(head, baseCommit, headCommit)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return mergeBase, nil
+		}
+
+		deepened := false
+		for _, side := range sides {
+			extent, err := manager.historyExtent(side.branch, side.commit)
+			if err != nil {
+				return "", err
+			}
+			if !extent.truncated || extent.commits >= maxDepth {
+				continue
+			}
+
+			more, err := side.branch.deepen(ctx, side.commit, min(max(extent.commits, minDeepen), maxDepth-extent.commits))
+			if err != nil {
+				return "", err
+			}
+			deepened = deepened || more.commits > extent.commits
+		}
+		if !deepened {
+			return "", ErrNoMergeBase
+		}
+	}
+}
+
+// diffEntry is a line of git's raw diff format.
+type diffEntry struct {
+	oldMode, newMode string
+	oldID, newID     string
+	status           byte
+	path, oldPath    string
+}
+
+// blobs returns the IDs of the file contents the entry compares.
+func (e diffEntry) blobs() []string {
+	var ids []string
+	if e.oldMode != "000000" && e.oldMode != gitlinkMode {
+		ids = append(ids, e.oldID)
+	}
+	if e.newMode != "000000" && e.newMode != gitlinkMode {
+		ids = append(ids, e.newID)
+	}
+	return ids
+}
+
+// parseRawDiff parses the output of diff-tree -z --raw, and returns the
+// patches that follow the entries when -p was given too.
+func parseRawDiff(output string) ([]diffEntry, string, error) {
+	var entries []diffEntry
+	for strings.HasPrefix(output, ":") {
+		header, rest, _ := strings.Cut(output[1:], "\x00")
+		fields := strings.Fields(header)
+		if len(fields) != 5 || fields[4] == "" {
+			return nil, "", fmt.Errorf("failed to parse diff entry %q", header)
+		}
+
+		entry := diffEntry{oldMode: fields[0], newMode: fields[1], oldID: fields[2], newID: fields[3], status: fields[4][0]}
+		entry.path, rest, _ = strings.Cut(rest, "\x00")
+		if entry.status == 'R' || entry.status == 'C' {
+			entry.oldPath = entry.path
+			entry.path, rest, _ = strings.Cut(rest, "\x00")
+		}
+
+		entries = append(entries, entry)
+		output = rest
+	}
+
+	return entries, strings.TrimPrefix(output, "\x00"), nil
+}
+
+// parseDiff turns the output of diff-tree -z --raw, with or without -p, into
+// file changes. Patches come in the order of the entries, one per entry
+// except for changes of type, which git shows as a deletion and an addition.
+func parseDiff(output []byte) ([]FileChange, error) {
+	entries, patch, err := parseRawDiff(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	sections := splitPatch(patch)
+	files := make([]FileChange, 0, len(entries))
+	for _, entry := range entries {
+		status, ok := diffStatuses[entry.status]
+		if !ok {
+			return nil, fmt.Errorf("unexpected diff status %q", entry.status)
+		}
+
+		file := FileChange{Path: entry.path, OldPath: entry.oldPath, Status: status}
+		if len(sections) > 0 {
+			count := 1
+			if entry.status == 'T' {
+				count = 2
+			}
+			if len(sections) < count {
+				return nil, fmt.Errorf("missing patch for %s", entry.path)
+			}
+			file.Patch = strings.Join(sections[:count], "")
+			sections = sections[count:]
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// splitPatch splits a patch into the parts of each file. Lines of content are
+// prefixed in a patch, so a line starting with "diff --git" always begins a
+// file's part.
+func splitPatch(patch string) []string {
+	var sections []string
+	for patch != "" {
+		next := strings.Index(patch, "\ndiff --git ")
+		if next < 0 {
+			sections = append(sections, patch)
+			break
+		}
+		sections = append(sections, patch[:next+1])
+		patch = patch[next+1:]
+	}
+	return sections
+}
@@ -0,0 +1,81 @@
+package gitcache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commit("kept.txt", "kept")
+	remote.commit("moved.txt", "a file long enough for its rename to be detected\n")
+	remote.commit("deleted.txt", "deleted")
+	remote.commit("typed.txt", "typed")
+	base := remote.commit("modified.txt", "before\n")
+
+	remote.git("checkout", "--quiet", "-b", "feature")
+	require.NoError(t, os.Mkdir(filepath.Join(remote.path, "dir"), 0755))
+	remote.git("mv", "moved.txt", "dir/renamed.txt")
+	remote.git("rm", "--quiet", "deleted.txt", "typed.txt")
+	require.NoError(t, os.Symlink("kept.txt", filepath.Join(remote.path, "typed.txt")))
+	remote.git("add", "typed.txt")
+	remote.commit("modified.txt", "after\n")
+	head := remote.commit("added.txt", "added")
+
+	// Changes to main after the fork aren't part of the comparison.
+	remote.git("checkout", "--quiet", "main")
+	mainTip := remote.commit("main-only.txt", "main only")
+
+	caches := map[string]*GitCache{
+		"worktree":     newTestDefaultCache(t),
+		"object-store": newTestObjectStoreCache(t),
+	}
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.cfg.MaxHistoryDepth = 1000
+			comparison, err := cache.Compare(context.Background(), "compare-repo", remote.url, "main", "feature", false)
+			require.NoError(t, err)
+			assert.Equal(t, mainTip, comparison.BaseCommit)
+			assert.Equal(t, head, comparison.HeadCommit)
+			assert.Equal(t, base, comparison.MergeBaseCommit)
+			assert.Equal(t, []FileChange{
+				{Path: "added.txt", Status: "added"},
+				{Path: "deleted.txt", Status: "deleted"},
+				{Path: "dir/renamed.txt", OldPath: "moved.txt", Status: "renamed"},
+				{Path: "modified.txt", Status: "modified"},
+				{Path: "typed.txt", Status: "modified"},
+			}, comparison.Files)
+
+			comparison, err = cache.Compare(context.Background(), "compare-repo", remote.url, "main", "feature", true)
+			require.NoError(t, err)
+			require.Len(t, comparison.Files, 5)
+
+			patches := make(map[string]string)
+			for _, file := range comparison.Files {
+				patches[file.Path] = file.Patch
+			}
+			assert.True(t, strings.HasPrefix(patches["modified.txt"], "diff --git a/modified.txt b/modified.txt\n"))
+			assert.True(t, strings.HasSuffix(patches["modified.txt"], "--- a/modified.txt\n+++ b/modified.txt\n@@ -1 +1 @@\n-before\n+after\n"))
+			assert.Contains(t, patches["added.txt"], "+added")
+			assert.Contains(t, patches["deleted.txt"], "-deleted")
+			assert.Contains(t, patches["dir/renamed.txt"], "rename from moved.txt")
+			assert.Contains(t, patches["typed.txt"], "deleted file mode 100644")
+			assert.Contains(t, patches["typed.txt"], "new file mode 120000")
+
+			_, err = cache.Compare(context.Background(), "compare-repo", remote.url, "main", "missing", false)
+			assert.ErrorIs(t, err, ErrRefNotFound)
+		})
+	}
+
+	// Without deepening, the shallow histories of the refs never meet.
+	cache := newTestObjectStoreCache(t)
+	_, err := cache.Compare(context.Background(), "compare-repo", remote.url, "main", "feature", false)
+	assert.ErrorIs(t, err, ErrNoMergeBase)
+}
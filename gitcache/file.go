@@ -0,0 +1,34 @@
+package gitcache
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// memoryFile serves content that is already in memory.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func newMemoryFile(content []byte) memoryFile {
+	return memoryFile{Reader: bytes.NewReader(content)}
+}
+
+func (f memoryFile) Close() error {
+	return nil
+}
+
+// branchFile keeps the branch a file is read from acquired until the file is
+// closed, so that the branch can't be evicted while it is streamed.
+type branchFile struct {
+	io.ReadSeekCloser
+	branch *gitBranch
+	once   sync.Once
+}
+
+func (f *branchFile) Close() error {
+	err := f.ReadSeekCloser.Close()
+	f.once.Do(f.branch.release)
+	return err
+}
@@ -0,0 +1,84 @@
+package gitcache
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup runs a single operation at a time per key, such as the clone of
+// a ref, and shares its result with every caller that asks for the same key
+// while it runs.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done     chan struct{}
+	err      error
+	waiters  int
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do runs fn for key, or joins the run already in flight, and waits for it to
+// finish. A caller stops waiting as soon as its ctx is done. fn runs under a
+// context derived from base, which is canceled once every caller has stopped
+// waiting. A canceled run stays in flight until fn returns, since not every
+// step of fn heeds its context, and later callers wait for it to end before
+// they start over.
+func (g *flightGroup) do(ctx, base context.Context, key string, fn func(ctx context.Context) error) error {
+	for {
+		g.mu.Lock()
+		f, ok := g.flights[key]
+		if ok && f.canceled {
+			g.mu.Unlock()
+
+			select {
+			case <-f.done:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if !ok {
+			runCtx, cancel := context.WithCancel(base)
+			f = &flight{done: make(chan struct{}), cancel: cancel}
+			g.flights[key] = f
+
+			go func() {
+				f.err = fn(runCtx)
+				cancel()
+
+				g.mu.Lock()
+				delete(g.flights, key)
+				g.mu.Unlock()
+
+				close(f.done)
+			}()
+		}
+		f.waiters++
+		g.mu.Unlock()
+
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			g.mu.Lock()
+			f.waiters--
+			if f.waiters == 0 {
+				// Later callers start over rather than join a canceled run.
+				f.cancel()
+				f.canceled = true
+			}
+			g.mu.Unlock()
+
+			return ctx.Err()
+		}
+	}
+}
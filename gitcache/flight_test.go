@@ -0,0 +1,158 @@
+package gitcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingCloneManager holds every clone until release is closed.
+type blockingCloneManager struct {
+	*mockGitManager
+	clones  atomic.Int32
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingCloneManager() *blockingCloneManager {
+	return &blockingCloneManager{
+		mockGitManager: newMockGitManager(),
+		started:        make(chan string, 10),
+		release:        make(chan struct{}),
+	}
+}
+
+func (m *blockingCloneManager) cloneBranch(b *gitBranch) error {
+	m.clones.Add(1)
+	m.started <- b.repo.hash
+	<-m.release
+	return m.mockGitManager.cloneBranch(b)
+}
+
+func newFlightTestCache(t *testing.T, manager GitCacheManager, maxClones int) *GitCache {
+	cfg := &config.Config{
+		StorageFolder:       t.TempDir(),
+		RepoTTL:             time.Hour,
+		RepoCheckInterval:   time.Minute,
+		MaxConcurrentClones: maxClones,
+	}
+	return NewGitCache(cfg, context.Background(), manager)
+}
+
+func TestConcurrentClonesAreCoalesced(t *testing.T) {
+	manager := newBlockingCloneManager()
+	cache := newFlightTestCache(t, manager, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.GetFileBlob(context.Background(), "repo", "https://example.com/repo.git", "main", "file.txt")
+			errs <- err
+		}()
+	}
+
+	<-manager.started
+	close(manager.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), manager.clones.Load())
+}
+
+func TestCloneWaitHonorsContext(t *testing.T) {
+	manager := newBlockingCloneManager()
+	cache := newFlightTestCache(t, manager, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := cache.GetFileBlob(ctx, "repo", "https://example.com/repo.git", "main", "file.txt")
+		errs <- err
+	}()
+
+	<-manager.started
+	cancel()
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("a canceled request should stop waiting for the clone")
+	}
+
+	// The clone that started is completed and serves later requests.
+	close(manager.release)
+	_, err := cache.GetFileBlob(context.Background(), "repo", "https://example.com/repo.git", "main", "file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), manager.clones.Load())
+}
+
+func TestCanceledCloneHoldsItsFlight(t *testing.T) {
+	manager := newBlockingCloneManager()
+	cache := newFlightTestCache(t, manager, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 3)
+	go func() {
+		_, err := cache.GetFileBlob(ctx, "repo", "https://example.com/repo.git", "main", "file.txt")
+		errs <- err
+	}()
+
+	<-manager.started
+	cancel()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// A later request waits for the canceled clone, which is still running,
+	// rather than take another slot to clone next to it.
+	go func() {
+		_, err := cache.GetFileBlob(context.Background(), "repo", "https://example.com/repo.git", "main", "file.txt")
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		_, err := cache.GetFileBlob(context.Background(), "other", "https://example.com/other.git", "main", "file.txt")
+		errs <- err
+	}()
+
+	select {
+	case hash := <-manager.started:
+		assert.Equal(t, "other", hash)
+	case <-time.After(time.Second):
+		t.Fatal("the clone of another repo should get the free slot")
+	}
+
+	close(manager.release)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	assert.Equal(t, int32(2), manager.clones.Load())
+}
+
+func TestConcurrentClonesAreLimited(t *testing.T) {
+	manager := newBlockingCloneManager()
+	cache := newFlightTestCache(t, manager, 1)
+
+	go cache.GetFileBlob(context.Background(), "first", "https://example.com/first.git", "main", "file.txt")
+	<-manager.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := cache.GetFileBlob(ctx, "second", "https://example.com/second.git", "main", "file.txt")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), manager.clones.Load(), "the second clone should wait for a free slot")
+
+	close(manager.release)
+	_, err = cache.GetFileBlob(context.Background(), "second", "https://example.com/second.git", "main", "file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), manager.clones.Load())
+}
@@ -1,73 +1,537 @@
 package gitcache
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/costinul/git-rest-cache/gitauth"
+	"github.com/costinul/git-rest-cache/logger"
 )
 
 type GitCacheManager interface {
-	readFile(b *gitBranch, filePath string) ([]byte, error)
+	openFile(b *gitBranch, filePath string) (io.ReadSeekCloser, int64, error)
+	resolveRef(b *gitBranch) (refKind, error)
 	cloneBranch(b *gitBranch) error
-	updateBranch(b *gitBranch) error
+	updateBranch(ctx context.Context, b *gitBranch) error
+	resetBranch(ctx context.Context, b *gitBranch) error
+	headSHA(b *gitBranch) (string, error)
+	blobIDs(b *gitBranch, commit, dir string) (map[string]string, error)
+	objectID(b *gitBranch, commit, objectPath string) (string, string, error)
+	lastModified(b *gitBranch, commit, objectPath string) (time.Time, error)
+	log(b *gitBranch, commit, logPath string, opts LogOptions) ([]Commit, error)
+	historyExtent(b *gitBranch, commit string) (historyExtent, error)
+	deepen(ctx context.Context, b *gitBranch, commits int) error
+	mergeBase(b *gitBranch, base, head string) (string, bool, error)
+	diff(b *gitBranch, base, head string, patch bool) ([]FileChange, error)
+	remoteHeads(ctx context.Context, r *gitRepo, branches []string) (map[string]string, error)
 	deleteBranch(b *gitBranch) error
 	containsBranch(b *gitBranch) bool
 	deleteRepo(r *gitRepo) error
 	getCachedRepoBranches(storageFolder string) ([]repoBranchInfo, error)
-	listTree(b *gitBranch, path string) ([]byte, error)
+	listTree(b *gitBranch, path string, recursive, sizes bool) (io.ReadCloser, error)
 }
 
+// DefaultGitManager keeps one bare object store per repo under
+// <hash>/.store and checks every cached ref out as a worktree under
+// <hash>/<ref>. Ref names can't start with a dot, so the store never clashes
+// with a worktree.
 type DefaultGitManager struct{}
 
+const storeDir = ".store"
+
+// symlinkMode is the tree entry mode of symbolic links.
+const symlinkMode = "120000"
+
+// gitlinkMode is the tree entry mode of submodules.
+const gitlinkMode = "160000"
+
+var commitSHARegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
 type TestGitManager struct {
-	ReadFileCallback func(gitUrl, branch, filePath string) ([]byte, error)
-	ListTreeCallback func(gitUrl, branch, path string) ([]byte, error)
+	ReadFileCallback     func(gitUrl, branch, filePath string) ([]byte, error)
+	ListTreeCallback     func(gitUrl, branch, path string) ([]byte, error)
+	UpdateBranchCallback func(gitUrl, branch string) error
 }
 
-func (m *DefaultGitManager) readFile(b *gitBranch, filePath string) ([]byte, error) {
+// openFile opens the file in the worktree. Resets replace files rather than
+// rewriting them, so an open file keeps its content while the branch moves.
+func (m *DefaultGitManager) openFile(b *gitBranch, filePath string) (io.ReadSeekCloser, int64, error) {
 	b.repo.rmu.RLock()
 	defer b.repo.rmu.RUnlock()
 
-	fp := filepath.Join(b.path, filepath.FromSlash(filePath))
-	info, err := os.Stat(fp)
+	f, err := os.Open(filepath.Join(b.path, filepath.FromSlash(filePath)))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, ErrFileNotFound
+			return nil, 0, ErrFileNotFound
 		}
-		return nil, fmt.Errorf("failed to stat file: %w", err)
+		return nil, 0, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to stat file: %w", err)
 	}
 	if info.IsDir() {
-		return nil, ErrFileNotFound
+		f.Close()
+		return nil, 0, ErrFileNotFound
 	}
 
-	content, err := os.ReadFile(fp)
+	return f, info.Size(), nil
+}
+
+func (m *DefaultGitManager) resolveRef(b *gitBranch) (refKind, error) {
+	if m.containsBranch(b) {
+		return localRefKind(b.repo.storePath(), b.name)
+	}
+
+	return resolveRemoteRef(b)
+}
+
+func resolveRemoteRef(b *gitBranch) (refKind, error) {
+	remote := b.repo.remote()
+	cmd := remote.command(b.repo.cache.ctx, "ls-remote", remote.url, "refs/heads/"+b.name, "refs/tags/"+b.name)
+	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return refUnknown, fmt.Errorf("failed to list remote refs: %w, output: %s", err, remote.redact(exitErr.Stderr))
+		}
+		return refUnknown, fmt.Errorf("failed to list remote refs: %w", err)
+	}
+
+	kind := refUnknown
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[1] {
+		case "refs/heads/" + b.name:
+			return refBranch, nil
+		case "refs/tags/" + b.name:
+			kind = refTag
+		}
+	}
+
+	if kind != refUnknown {
+		return kind, nil
+	}
+
+	if commitSHARegex.MatchString(b.name) {
+		return refCommit, nil
 	}
 
-	return content, nil
+	return refUnknown, ErrRefNotFound
 }
 
+// cloneBranch fetches a single ref into the repo's shared object store and
+// checks it out as a detached worktree, so a second branch of the same repo
+// only costs the objects that differ.
 func (m *DefaultGitManager) cloneBranch(b *gitBranch) error {
-	cmd := exec.CommandContext(b.repo.cache.ctx, "git", "clone", "--depth=1", "--branch", b.name, b.repo.gitUrl, b.path)
+	remote := b.repo.remote()
+	if err := ensureStore(b.repo, remote); err != nil {
+		return err
+	}
+
+	if err := fetchRef(b.repo.cache.ctx, b, remote); err != nil {
+		return err
+	}
+
+	storePath := b.repo.storePath()
+	output, err := exec.CommandContext(b.repo.cache.ctx, "git", "-C", storePath, "worktree", "add", "--detach", "--quiet", b.path, localRef(b)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to add worktree: %w, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+type gitSetting = gitauth.Setting
+
+func ensureStore(r *gitRepo, remote *gitRemote, settings ...gitSetting) error {
+	storePath := r.storePath()
+	if _, err := os.Stat(storePath); err == nil {
+		return nil
+	}
+
+	commands := [][]string{
+		{"init", "--bare", "--quiet", storePath},
+		{"-C", storePath, "config", "remote.origin.url", remote.url},
+	}
+	for _, setting := range settings {
+		commands = append(commands, []string{"-C", storePath, "config", setting.Key, setting.Value})
+	}
+
+	for _, args := range commands {
+		output, err := exec.CommandContext(r.cache.ctx, "git", args...).CombinedOutput()
+		if err != nil {
+			_ = os.RemoveAll(storePath)
+			return fmt.Errorf("failed to create object store: %w, output: %s", err, string(output))
+		}
+	}
+
+	return markCredentials(remote, storePath)
+}
+
+// storeHeadSHA returns the commit the local ref of a cached ref points to.
+func storeHeadSHA(b *gitBranch) (string, error) {
+	output, err := exec.Command("git", "-C", b.repo.storePath(), "rev-parse", "--verify", "--quiet", localRef(b)+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve head of %s: %w", b.name, err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// storeBlobIDs returns the object IDs of the blobs in a directory of a cached
+// commit, by file name. It only reads trees, so partial clones don't fetch
+// any blob. Symlinks are left out, since worktrees serve what they point to.
+func storeBlobIDs(b *gitBranch, commit, dir string) (map[string]string, error) {
+	output, err := exec.Command("git", "-C", b.repo.storePath(), "ls-tree", "-z", commit+":"+dir).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree: %w", err)
+	}
+
+	ids := make(map[string]string)
+	for _, entry := range bytes.Split(output, []byte{0}) {
+		meta, name, ok := strings.Cut(string(entry), "\t")
+		fields := strings.Fields(meta)
+		if ok && len(fields) == 3 && fields[1] == "blob" && fields[0] != symlinkMode {
+			ids[name] = fields[2]
+		}
+	}
+
+	return ids, nil
+}
+
+// storeObjectID returns the type and the object ID of the blob or tree at a
+// path of a cached commit, or empty strings when there is none.
+func storeObjectID(b *gitBranch, commit, objectPath string) (string, string, error) {
+	if objectPath == "" {
+		output, err := exec.Command("git", "-C", b.repo.storePath(), "rev-parse", "--verify", "--quiet", commit+"^{tree}").Output()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to resolve tree of %s: %w", commit, err)
+		}
+		return "tree", strings.TrimSpace(string(output)), nil
+	}
+
+	output, err := exec.Command("git", "--literal-pathspecs", "-C", b.repo.storePath(), "ls-tree", "-z", commit, "--", objectPath).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to list tree: %w", err)
+	}
+
+	meta, name, ok := strings.Cut(strings.TrimSuffix(string(output), "\x00"), "\t")
+	fields := strings.Fields(meta)
+	if !ok || name != objectPath || len(fields) != 3 || fields[0] == symlinkMode {
+		return "", "", nil
+	}
+	if fields[1] != "blob" && fields[1] != "tree" {
+		return "", "", nil
+	}
+
+	return fields[1], fields[2], nil
+}
+
+// storeLastModified returns the commit time of the last commit that touched
+// a path, up to a cached commit. Shallow clones only know their last commit,
+// so for them it is the time of that commit, which the path can't be newer
+// than.
+func storeLastModified(b *gitBranch, commit, objectPath string) (time.Time, error) {
+	args := []string{"--literal-pathspecs", "-C", b.repo.storePath(), "log", "-1", "--format=%ct", commit}
+	if objectPath != "" {
+		args = append(args, "--", objectPath)
+	}
+
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read history of %s: %w", objectPath, err)
+	}
+
+	timestamp := strings.TrimSpace(string(output))
+	if timestamp == "" {
+		return time.Time{}, nil
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse commit time %q: %w", timestamp, err)
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+// logFormat separates the fields of a commit with unit separators. The
+// message comes last, so that it may contain them.
+const logFormat = "%H%x1f%P%x1f%an%x1f%ae%x1f%aI%x1f%cn%x1f%ce%x1f%cI%x1f%B"
+
+// storeLog returns the commits that touched a path, newest first, up to a
+// cached commit.
+func storeLog(b *gitBranch, commit, logPath string, opts LogOptions) ([]Commit, error) {
+	args := []string{"--literal-pathspecs", "-C", b.repo.storePath(), "log", "-z", "--format=" + logFormat}
+	if opts.Limit > 0 {
+		args = append(args, "-n", strconv.Itoa(opts.Limit))
+	}
+	if !opts.Since.IsZero() {
+		args = append(args, "--since="+opts.Since.Format(time.RFC3339))
+	}
+	if !opts.Until.IsZero() {
+		args = append(args, "--until="+opts.Until.Format(time.RFC3339))
+	}
+	args = append(args, commit)
+	if logPath != "" {
+		args = append(args, "--", logPath)
+	}
+
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	commits := []Commit{}
+	for _, record := range strings.Split(string(output), "\x00") {
+		fields := strings.SplitN(record, "\x1f", 9)
+		if len(fields) != 9 {
+			continue
+		}
+
+		authored, err := time.Parse(time.RFC3339, fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse author date %q: %w", fields[4], err)
+		}
+		committed, err := time.Parse(time.RFC3339, fields[7])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse commit date %q: %w", fields[7], err)
+		}
+
+		commits = append(commits, Commit{
+			SHA:       fields[0],
+			Parents:   strings.Fields(fields[1]),
+			Author:    Signature{Name: fields[2], Email: fields[3], Date: authored},
+			Committer: Signature{Name: fields[5], Email: fields[6], Date: committed},
+			Message:   strings.TrimRight(fields[8], "\n"),
+		})
+	}
+
+	return commits, nil
+}
+
+// storeHistoryExtent describes the part of the history of a commit that the
+// store has.
+func storeHistoryExtent(b *gitBranch, commit string) (historyExtent, error) {
+	output, err := exec.Command("git", "-C", b.repo.storePath(), "log", "--format=%H %ct", commit).Output()
+	if err != nil {
+		return historyExtent{}, fmt.Errorf("failed to list history: %w", err)
+	}
+
+	shallow, err := os.ReadFile(filepath.Join(b.repo.storePath(), "shallow"))
+	if err != nil && !os.IsNotExist(err) {
+		return historyExtent{}, fmt.Errorf("failed to read shallow commits: %w", err)
+	}
+	boundary := make(map[string]bool)
+	for _, sha := range strings.Fields(string(shallow)) {
+		boundary[sha] = true
+	}
+
+	var extent historyExtent
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		sha, timestamp, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return historyExtent{}, fmt.Errorf("failed to parse commit time %q: %w", timestamp, err)
+		}
+
+		extent.commits++
+		if boundary[sha] {
+			extent.truncated = true
+		}
+		if committed := time.Unix(seconds, 0); extent.oldest.IsZero() || committed.Before(extent.oldest) {
+			extent.oldest = committed
+		}
+	}
+
+	return extent, nil
+}
+
+// deepenRef fetches older commits of a cached ref. Only FETCH_HEAD is
+// written, so the local ref stays at the commit the ref is cached at even if
+// the remote has moved on.
+func deepenRef(ctx context.Context, b *gitBranch, remote *gitRemote, commits int, args ...string) error {
+	args = append([]string{"-C", b.repo.storePath(), "fetch", "--deepen=" + strconv.Itoa(commits), "--no-tags", "--quiet"}, args...)
+	cmd := remote.command(ctx, append(args, "origin", remoteRef(b))...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to clone branch: %w, output: %s", err, string(output))
+		return fmt.Errorf("failed to deepen ref: %w, output: %s", err, remote.redact(output))
 	}
 
 	return nil
 }
 
-func (m *DefaultGitManager) updateBranch(b *gitBranch) error {
-	cmd := exec.CommandContext(b.repo.cache.ctx, "git", "-C", b.path, "fetch", "origin", b.name, "--depth=1")
+// storeMergeBase returns the best common ancestor of two commits, if the
+// history the store has of them meets.
+func storeMergeBase(b *gitBranch, base, head string) (string, bool, error) {
+	output, err := exec.Command("git", "-C", b.repo.storePath(), "merge-base", base, head).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to find merge base: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), true, nil
+}
+
+// storeDiff compares the trees of two commits, with renames detected and,
+// when patch is set, the unified diff of every file.
+func storeDiff(b *gitBranch, base, head string, patch bool) ([]FileChange, error) {
+	args := []string{"-C", b.repo.storePath(), "diff-tree", "-r", "-M", "-z", "--raw"}
+	if patch {
+		args = append(args, "-p")
+	}
+	args = append(args, base, head)
+
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare commits: %w", err)
+	}
+
+	return parseDiff(output)
+}
+
+// lsRemoteHeads returns the commits the branches point to on the remote,
+// with a single ls-remote for all of them. Branches missing on the remote are
+// left out.
+func lsRemoteHeads(ctx context.Context, r *gitRepo, branches []string) (map[string]string, error) {
+	remote := r.remote()
+	args := []string{"ls-remote", "--heads", remote.url}
+	for _, branch := range branches {
+		args = append(args, "refs/heads/"+branch)
+	}
+
+	output, err := remote.command(ctx, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to list remote heads: %w, output: %s", err, remote.redact(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("failed to list remote heads: %w", err)
+	}
+
+	heads := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if branch, ok := strings.CutPrefix(parts[1], "refs/heads/"); ok {
+			heads[branch] = parts[0]
+		}
+	}
+
+	return heads, nil
+}
+
+func fetchRef(ctx context.Context, b *gitBranch, remote *gitRemote, args ...string) error {
+	refspec := fmt.Sprintf("+%s:%s", remoteRef(b), localRef(b))
+	args = append([]string{"-C", b.repo.storePath(), "fetch", "--depth=1", "--no-tags", "--quiet"}, args...)
+	cmd := remote.command(ctx, append(args, "origin", refspec)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to fetch branch: %w, output: %s", err, string(output))
+		return fmt.Errorf("failed to fetch ref: %w, output: %s", err, remote.redact(output))
+	}
+
+	return nil
+}
+
+// markCredentials records, without the credentials themselves, that a clone
+// needs them, so background updates can wait until a request supplies them.
+func markCredentials(remote *gitRemote, path string) error {
+	if !remote.hasCredentials() {
+		return nil
+	}
+
+	output, err := exec.Command("git", "-C", path, "config", "gitrestcache.requirescredentials", "true").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to mark clone as private: %w, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+func requiresCredentials(path string) bool {
+	output, err := exec.Command("git", "-C", path, "config", "--bool", "--get", "gitrestcache.requirescredentials").Output()
+	if err != nil {
+		return false
 	}
+	return strings.TrimSpace(string(output)) == "true"
+}
 
-	cmd = exec.CommandContext(b.repo.cache.ctx, "git", "-C", b.path, "reset", "--hard", "origin/"+b.name)
-	output, err = cmd.CombinedOutput()
+func (m *DefaultGitManager) headSHA(b *gitBranch) (string, error) {
+	return storeHeadSHA(b)
+}
+
+func (m *DefaultGitManager) blobIDs(b *gitBranch, commit, dir string) (map[string]string, error) {
+	return storeBlobIDs(b, commit, dir)
+}
+
+func (m *DefaultGitManager) objectID(b *gitBranch, commit, objectPath string) (string, string, error) {
+	return storeObjectID(b, commit, objectPath)
+}
+
+func (m *DefaultGitManager) lastModified(b *gitBranch, commit, objectPath string) (time.Time, error) {
+	return storeLastModified(b, commit, objectPath)
+}
+
+func (m *DefaultGitManager) log(b *gitBranch, commit, logPath string, opts LogOptions) ([]Commit, error) {
+	return storeLog(b, commit, logPath, opts)
+}
+
+func (m *DefaultGitManager) historyExtent(b *gitBranch, commit string) (historyExtent, error) {
+	return storeHistoryExtent(b, commit)
+}
+
+func (m *DefaultGitManager) deepen(ctx context.Context, b *gitBranch, commits int) error {
+	return deepenRef(ctx, b, b.repo.remote(), commits)
+}
+
+func (m *DefaultGitManager) mergeBase(b *gitBranch, base, head string) (string, bool, error) {
+	return storeMergeBase(b, base, head)
+}
+
+func (m *DefaultGitManager) diff(b *gitBranch, base, head string, patch bool) ([]FileChange, error) {
+	return storeDiff(b, base, head, patch)
+}
+
+func (m *DefaultGitManager) remoteHeads(ctx context.Context, r *gitRepo, branches []string) (map[string]string, error) {
+	return lsRemoteHeads(ctx, r, branches)
+}
+
+func (m *DefaultGitManager) updateBranch(ctx context.Context, b *gitBranch) error {
+	return fetchRef(ctx, b, b.repo.remote())
+}
+
+// resetBranch moves the worktree of b to the ref updateBranch fetched.
+func (m *DefaultGitManager) resetBranch(ctx context.Context, b *gitBranch) error {
+	cmd := exec.CommandContext(ctx, "git", "-C", b.path, "reset", "--hard", "--quiet", localRef(b))
+	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to reset branch: %w, output: %s", err, string(output))
 	}
@@ -81,16 +545,29 @@ func (m *DefaultGitManager) deleteBranch(b *gitBranch) error {
 		return fmt.Errorf("failed to delete branch: %w", err)
 	}
 
+	storePath := b.repo.storePath()
+	commands := [][]string{
+		{"-C", storePath, "worktree", "prune"},
+		{"-C", storePath, "update-ref", "-d", localRef(b)},
+	}
+
+	for _, args := range commands {
+		output, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to delete branch: %w, output: %s", err, string(output))
+		}
+	}
+
 	return nil
 }
 
 func (m *DefaultGitManager) deleteRepo(r *gitRepo) error {
-	files, err := os.ReadDir(r.path)
+	worktrees, err := listWorktrees(r.storePath())
 	if err != nil {
-		return fmt.Errorf("failed to read repo directory: %w", err)
+		return fmt.Errorf("failed to read repo worktrees: %w", err)
 	}
 
-	if len(files) == 0 {
+	if len(worktrees) == 0 {
 		err = os.RemoveAll(r.path)
 		if err != nil {
 			return fmt.Errorf("failed to delete repo: %w", err)
@@ -110,55 +587,134 @@ func (m *DefaultGitManager) containsBranch(b *gitBranch) bool {
 		return false
 	}
 
-	gitPath := filepath.Join(b.path, ".git")
-	gitInfo, err := os.Stat(gitPath)
-	if os.IsNotExist(err) {
-		return false
-	}
-
-	return gitInfo.IsDir()
+	// In a worktree, .git is a file pointing at the shared object store.
+	_, err = os.Stat(filepath.Join(b.path, ".git"))
+	return err == nil
 }
 
+// getCachedRepoBranches lists the worktrees of every repo. A worktree or repo
+// that can't be read is logged and skipped, so that it doesn't keep the
+// others from being checked.
 func (m *DefaultGitManager) getCachedRepoBranches(storageFolder string) ([]repoBranchInfo, error) {
 	list := []repoBranchInfo{}
+	err := forEachStore(storageFolder, func(hash, repoPath, storePath, gitUrl string, credentials bool) error {
+		worktrees, err := listWorktrees(storePath)
+		if err != nil {
+			return fmt.Errorf("failed to read worktrees of repo %s: %w", hash, err)
+		}
+
+		repoRealPath, err := realPath(repoPath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve repo folder %s: %w", repoPath, err)
+		}
+
+		for _, worktree := range worktrees {
+			worktreeRealPath, err := realPath(worktree)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to resolve worktree %s: %v", worktree, err))
+				continue
+			}
+
+			rel, err := filepath.Rel(repoRealPath, worktreeRealPath)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+
+			branchName := filepath.ToSlash(rel)
+			kind, err := localRefKind(storePath, branchName)
+			if err != nil {
+				logger.Error(fmt.Sprintf("failed to get ref kind for %s/%s: %v", hash, branchName, err))
+				continue
+			}
+
+			list = append(list, repoBranchInfo{hash, branchName, gitUrl, kind, credentials})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// forEachStore calls fn for every repo object store in the storage folder.
+// Repos cached with the previous layout of one full clone per branch have no
+// store; they are removed and will be cloned again on demand. Other folders
+// without a store, such as a repo whose store is being created, are left
+// alone. A repo that
+// fails is logged and skipped, so only an unreadable storage folder is an
+// error.
+func forEachStore(storageFolder string, fn func(hash, repoPath, storePath, gitUrl string, credentials bool) error) error {
 	repos, err := os.ReadDir(storageFolder)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read storage folder: %w", err)
+		return fmt.Errorf("failed to read storage folder: %w", err)
 	}
 
 	for _, repo := range repos {
-		if !repo.IsDir() {
+		if !repo.IsDir() || strings.HasPrefix(repo.Name(), ".") {
 			continue
 		}
 
 		hash := repo.Name()
 		repoPath := filepath.Join(storageFolder, hash)
-		branches, err := os.ReadDir(repoPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read repo folder %s: %w", repoPath, err)
-		}
-
-		for _, branch := range branches {
-			if !branch.IsDir() {
+		storePath := filepath.Join(repoPath, storeDir)
+		if _, err := os.Stat(storePath); os.IsNotExist(err) {
+			if !isLegacyClones(repoPath) {
+				logger.Debug(fmt.Sprintf("skipping folder %s, which holds no repo store", repoPath))
 				continue
 			}
 
-			branchName := branch.Name()
-			branchPath := filepath.Join(repoPath, branchName)
-			gitUrl, err := getGitURL(branchPath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get git url for branch %s: %w", branchName, err)
+			logger.Info(fmt.Sprintf("removing repo %s cached with a previous storage layout", hash))
+			if err := os.RemoveAll(repoPath); err != nil {
+				logger.Error(fmt.Sprintf("failed to remove repo folder %s: %v", repoPath, err))
 			}
+			continue
+		}
 
-			list = append(list, repoBranchInfo{hash, branchName, gitUrl})
+		gitUrl, err := getGitURL(storePath)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to get git url for repo %s: %v", hash, err))
+			continue
 		}
 
+		if err := fn(hash, repoPath, storePath, gitUrl, requiresCredentials(storePath)); err != nil {
+			logger.Error(err.Error())
+		}
 	}
 
-	return list, nil
+	return nil
+}
+
+// isLegacyClones reports whether dir holds nothing but clones of the previous
+// layout, which nests the clone of a branch like feature/x as feature/x/.git.
+func isLegacyClones(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) == 0 {
+		return false
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			return false
+		}
+
+		branchPath := filepath.Join(dir, entry.Name())
+		if info, err := os.Stat(filepath.Join(branchPath, ".git")); err == nil && info.IsDir() {
+			continue
+		}
+
+		if !isLegacyClones(branchPath) {
+			return false
+		}
+	}
+
+	return true
 }
 
-func (m *DefaultGitManager) listTree(b *gitBranch, path string) ([]byte, error) {
+// listTree always lists sizes, since every blob is at hand.
+func (m *DefaultGitManager) listTree(b *gitBranch, path string, recursive, sizes bool) (io.ReadCloser, error) {
 	fullPath := filepath.Join(b.path, path)
 	if info, err := os.Stat(fullPath); err != nil {
 		if os.IsNotExist(err) {
@@ -170,13 +726,157 @@ func (m *DefaultGitManager) listTree(b *gitBranch, path string) ([]byte, error)
 	}
 
 	cmd := exec.CommandContext(b.repo.cache.ctx, "git", "-C", b.path, "ls-tree", "-l", "HEAD:"+path)
-	output, err := cmd.CombinedOutput()
+	if recursive {
+		cmd.Args = append(cmd.Args, "-r", "-t")
+	}
+
+	return startTreeListing(cmd)
+}
+
+// treeListing streams the output of ls-tree, so that large trees are never
+// held in memory whole.
+type treeListing struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	eof    bool
+	closed bool
+}
+
+func startTreeListing(cmd *exec.Cmd) (*treeListing, error) {
+	l := &treeListing{cmd: cmd}
+	cmd.Stderr = &l.stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tree listing: %w", err)
+	}
+	l.stdout = stdout
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to list tree: %w", err)
+	}
+
+	return l, nil
+}
+
+func (l *treeListing) Read(p []byte) (int, error) {
+	n, err := l.stdout.Read(p)
+	if err == io.EOF {
+		l.eof = true
+	}
+	return n, err
+}
+
+// Close stops git when the listing wasn't read to the end, and otherwise
+// reports whether git failed.
+func (l *treeListing) Close() error {
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	if !l.eof {
+		_ = l.cmd.Process.Kill()
+		_ = l.cmd.Wait()
+		return nil
+	}
+
+	if err := l.cmd.Wait(); err != nil {
+		return fmt.Errorf("failed to list tree: %w, output: %s", err, l.stderr.String())
+	}
+
+	return nil
+}
 
+// remoteRef is what gets fetched from origin for a cached ref.
+func remoteRef(b *gitBranch) string {
+	switch b.kind {
+	case refTag:
+		return "refs/tags/" + b.name
+	case refCommit:
+		return b.name
+	default:
+		return "refs/heads/" + b.name
+	}
+}
+
+// localRef is where a cached ref is kept in the object store. Commits get a
+// ref of their own so that they stay reachable.
+func localRef(b *gitBranch) string {
+	switch b.kind {
+	case refTag:
+		return "refs/tags/" + b.name
+	case refCommit:
+		return "refs/commits/" + b.name
+	default:
+		return "refs/heads/" + b.name
+	}
+}
+
+// localRefKind looks up which kind of ref was cached under name, using the
+// refs kept in the object store.
+func localRefKind(storePath, name string) (refKind, error) {
+	output, err := exec.Command("git", "-C", storePath, "for-each-ref", "--format=%(refname)",
+		"refs/heads/"+name, "refs/tags/"+name, "refs/commits/"+name).Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list tree: %w, output: %s", err, string(output))
+		return refUnknown, fmt.Errorf("failed to list refs: %w", err)
+	}
+
+	kind := refUnknown
+	for _, ref := range strings.Split(string(output), "\n") {
+		switch ref {
+		case "refs/heads/" + name:
+			return refBranch, nil
+		case "refs/tags/" + name:
+			kind = refTag
+		case "refs/commits/" + name:
+			if kind == refUnknown {
+				kind = refCommit
+			}
+		}
 	}
 
-	return output, nil
+	if kind == refUnknown {
+		return refUnknown, ErrRefNotFound
+	}
+
+	return kind, nil
+}
+
+func listWorktrees(storePath string) ([]string, error) {
+	output, err := exec.Command("git", "-C", storePath, "worktree", "list", "--porcelain").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list worktrees: %w", err)
+	}
+
+	var worktrees []string
+	for _, block := range strings.Split(string(output), "\n\n") {
+		var path string
+		skip := false
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "worktree "):
+				path = strings.TrimPrefix(line, "worktree ")
+			case line == "bare", strings.HasPrefix(line, "prunable"):
+				skip = true
+			}
+		}
+
+		if path != "" && !skip {
+			worktrees = append(worktrees, path)
+		}
+	}
+
+	return worktrees, nil
+}
+
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
 }
 
 // TestGitManager
@@ -185,22 +885,76 @@ func NewTestGitManager(readFileCallback func(gitUrl, branch, filePath string) ([
 	return &TestGitManager{ReadFileCallback: readFileCallback, ListTreeCallback: listTreeCallback}
 }
 
-func (m *TestGitManager) readFile(b *gitBranch, filePath string) ([]byte, error) {
+func (m *TestGitManager) openFile(b *gitBranch, filePath string) (io.ReadSeekCloser, int64, error) {
 	content, err := m.ReadFileCallback(b.repo.gitUrl, b.name, filePath)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	return newMemoryFile(content), int64(len(content)), nil
+}
+
+func (m *TestGitManager) resolveRef(b *gitBranch) (refKind, error) {
+	if commitSHARegex.MatchString(b.name) {
+		return refCommit, nil
 	}
-	return content, nil
+	return refBranch, nil
 }
 
 func (m *TestGitManager) cloneBranch(b *gitBranch) error {
 	return nil
 }
 
-func (m *TestGitManager) updateBranch(b *gitBranch) error {
+func (m *TestGitManager) updateBranch(ctx context.Context, b *gitBranch) error {
+	if m.UpdateBranchCallback != nil {
+		return m.UpdateBranchCallback(b.repo.gitUrl, b.name)
+	}
 	return nil
 }
 
+func (m *TestGitManager) resetBranch(ctx context.Context, b *gitBranch) error {
+	return nil
+}
+
+func (m *TestGitManager) headSHA(b *gitBranch) (string, error) {
+	return "", nil
+}
+
+func (m *TestGitManager) blobIDs(b *gitBranch, commit, dir string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (m *TestGitManager) objectID(b *gitBranch, commit, objectPath string) (string, string, error) {
+	return "", "", nil
+}
+
+func (m *TestGitManager) lastModified(b *gitBranch, commit, objectPath string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *TestGitManager) log(b *gitBranch, commit, logPath string, opts LogOptions) ([]Commit, error) {
+	return nil, nil
+}
+
+func (m *TestGitManager) historyExtent(b *gitBranch, commit string) (historyExtent, error) {
+	return historyExtent{}, nil
+}
+
+func (m *TestGitManager) deepen(ctx context.Context, b *gitBranch, commits int) error {
+	return nil
+}
+
+func (m *TestGitManager) mergeBase(b *gitBranch, base, head string) (string, bool, error) {
+	return base, true, nil
+}
+
+func (m *TestGitManager) diff(b *gitBranch, base, head string, patch bool) ([]FileChange, error) {
+	return []FileChange{}, nil
+}
+
+func (m *TestGitManager) remoteHeads(ctx context.Context, r *gitRepo, branches []string) (map[string]string, error) {
+	return nil, nil
+}
+
 func (m *TestGitManager) deleteBranch(b *gitBranch) error {
 	return nil
 }
@@ -217,10 +971,10 @@ func (m *TestGitManager) getCachedRepoBranches(storageFolder string) ([]repoBran
 	return []repoBranchInfo{}, nil
 }
 
-func (m *TestGitManager) listTree(b *gitBranch, path string) ([]byte, error) {
+func (m *TestGitManager) listTree(b *gitBranch, path string, recursive, sizes bool) (io.ReadCloser, error) {
 	content, err := m.ListTreeCallback(b.repo.gitUrl, b.name, path)
 	if err != nil {
 		return nil, err
 	}
-	return content, nil
+	return io.NopCloser(bytes.NewReader(content)), nil
 }
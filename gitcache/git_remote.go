@@ -0,0 +1,134 @@
+package gitcache
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/costinul/git-rest-cache/gitauth"
+)
+
+// gitRemote is a remote as git is run against it. url and header are those
+// of its credentials, which gitauth passes to git without writing them into
+// a clone's .git/config.
+//
+// settings are extra git configuration passed the same way, such as the CA
+// bundle of a remote with a private certificate authority, and env holds
+// extra environment variables, such as the ssh command of SSH remotes.
+type gitRemote struct {
+	url         string
+	header      string
+	credentials gitauth.Credentials
+	settings    []gitSetting
+	env         []string
+}
+
+func newGitRemote(gitUrl string, settings ...gitSetting) *gitRemote {
+	credentials := gitauth.FromURL(gitUrl)
+	return &gitRemote{
+		url:         credentials.URL,
+		header:      credentials.Header,
+		credentials: credentials,
+		settings:    settings,
+	}
+}
+
+func (g *gitRemote) hasCredentials() bool {
+	return g.header != ""
+}
+
+func (g *gitRemote) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := g.credentials.Command(ctx, g.settings, args...)
+	cmd.Env = append(cmd.Env, g.env...)
+	return cmd
+}
+
+func (g *gitRemote) redact(output []byte) string {
+	return g.credentials.Redact(output)
+}
+
+// sshEnv returns the environment that makes git connect to an SSH remote with
+// the deploy key configured for it, or nil for other remotes. Host keys are
+// checked strictly against the configured known_hosts file, which Start
+// requires along with deploy keys, so that a spoofed host is never offered
+// one.
+func sshEnv(cfg *config.Config, gitUrl string) []string {
+	host, repoPath, ok := parseSSHURL(gitUrl)
+	if !ok {
+		return nil
+	}
+
+	key, ok := cfg.SSHKeyFor(host, repoPath)
+	if !ok {
+		return nil
+	}
+
+	// Without a known_hosts file every host is unknown, so connections fail.
+	knownHosts := cfg.SSHKnownHosts
+	if knownHosts == "" {
+		knownHosts = os.DevNull
+	}
+
+	sshCommand := cfg.SSHCommand
+	if sshCommand == "" {
+		sshCommand = "ssh"
+	}
+
+	// git runs the command from inside the repo, so relative paths would not
+	// resolve against the working directory of the service.
+	command := []string{sshCommand,
+		"-F", "/dev/null",
+		"-i", shellQuote(absPath(key.Key)),
+		"-o", "IdentitiesOnly=yes",
+		"-o", "UserKnownHostsFile=" + shellQuote(absPath(knownHosts)),
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "BatchMode=yes",
+	}
+
+	return []string{
+		"GIT_SSH_COMMAND=" + strings.Join(command, " "),
+		"GIT_SSH_VARIANT=ssh",
+	}
+}
+
+// parseSSHURL returns the host and repo path of ssh://[user@]host[:port]/path
+// and scp-like [user@]host:path remotes.
+func parseSSHURL(gitUrl string) (host, repoPath string, ok bool) {
+	if strings.HasPrefix(gitUrl, "ssh://") {
+		u, err := url.Parse(gitUrl)
+		if err != nil || u.Hostname() == "" {
+			return "", "", false
+		}
+		return u.Hostname(), strings.TrimPrefix(u.Path, "/"), true
+	}
+
+	if strings.Contains(gitUrl, "://") {
+		return "", "", false
+	}
+
+	hostPart, repoPath, found := strings.Cut(gitUrl, ":")
+	if !found || strings.Contains(hostPart, "/") || repoPath == "" {
+		return "", "", false
+	}
+
+	if idx := strings.LastIndex(hostPart, "@"); idx >= 0 {
+		hostPart = hostPart[idx+1:]
+	}
+
+	return hostPart, repoPath, hostPart != ""
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func absPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
@@ -2,9 +2,10 @@ package gitcache
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"path"
 	"strconv"
 	"strings"
@@ -17,6 +18,48 @@ import (
 )
 
 var ErrFileNotFound = fmt.Errorf("file not found")
+var ErrRefNotFound = fmt.Errorf("ref not found")
+
+var errBranchInUse = fmt.Errorf("branch is being read")
+
+// defaultMaxUpdateBackoff caps the backoff of failing repos when
+// update-max-backoff is not set.
+const defaultMaxUpdateBackoff = time.Hour
+
+type refKind int
+
+const (
+	refUnknown refKind = iota
+	refBranch
+	refTag
+	refCommit
+)
+
+func parseRefKind(kind string) refKind {
+	switch kind {
+	case "branch":
+		return refBranch
+	case "tag":
+		return refTag
+	case "commit":
+		return refCommit
+	default:
+		return refUnknown
+	}
+}
+
+func (k refKind) String() string {
+	switch k {
+	case refBranch:
+		return "branch"
+	case refTag:
+		return "tag"
+	case refCommit:
+		return "commit"
+	default:
+		return "unknown"
+	}
+}
 
 type GitCache struct {
 	cfg        *config.Config
@@ -24,74 +67,260 @@ type GitCache struct {
 	repos      map[string]*gitRepo
 	manager    GitCacheManager
 
+	// cancel stops the background checks, and stopped is closed once they
+	// have returned.
 	running bool
 	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
 	cmu     sync.RWMutex
+
+	refreshes map[*gitBranch]*time.Timer
+	rfmu      sync.Mutex
+
+	// flights coalesces concurrent clones and fetches of a ref, and
+	// cloneSlots, when clones are limited, holds a token per running clone.
+	flights    *flightGroup
+	cloneSlots chan struct{}
+
+	// blobs, when enabled, keeps the contents of hot files in memory.
+	blobs *blobCache
+
+	// qmu serializes evictions, and imu writes of the index.
+	qmu sync.Mutex
+	imu sync.Mutex
+}
+
+// RefStatus describes a cached ref: the commit it is checked out at, and when
+// the remote was last checked for a newer one.
+type RefStatus struct {
+	Ref         string    `json:"ref"`
+	Kind        string    `json:"kind"`
+	Commit      string    `json:"commit"`
+	LastChecked time.Time `json:"last_checked"`
+}
+
+// ObjectInfo identifies the file or directory at a path of a cached ref. Type
+// is "blob" or "dir", Hash its git object ID and LastModified the time of the
+// last commit that touched it. They are empty when they aren't known.
+type ObjectInfo struct {
+	Type         string    `json:"type"`
+	Hash         string    `json:"hash"`
+	Commit       string    `json:"commit"`
+	LastModified time.Time `json:"last_modified"`
 }
 
+// GitItem is an entry of a directory listing. Size is 0 for directories, and
+// left out of listings made with ListOptions.OmitSizes.
 type GitItem struct {
 	Hash string `json:"hash"`
 	Path string `json:"path"`
 	Type string `json:"type"`
-	Size int64  `json:"size"`
+	Size *int64 `json:"size,omitempty"`
 }
 
-type gitRepo struct {
-	cache    *GitCache
-	hash     string
-	gitUrl   string
-	path     string
-	branches map[string]*gitBranch
+// URLSource returns the git URL of a repo whose credentials expire, such as
+// GitHub App installation tokens.
+type URLSource func() string
+
+// Origin names the provider a repo was requested through, and the path of
+// the repo in it, such as "owner/repo".
+type Origin struct {
+	Provider string
+	Repo     string
+}
 
+type gitRepo struct {
+	cache     *GitCache
+	hash      string
+	gitUrl    string
+	urlSource URLSource
+	origin    Origin
+	path      string
+	branches  map[string]*gitBranch
+
+	// failures counts the background checks of the repo that failed in a
+	// row, and retryAt is when the next one is due.
+	failures int
+	retryAt  time.Time
+
+	// storeSize is the disk usage of the store shared by the branches.
+	storeSize int64
+
+	// rmu guards the state of the repo and its branches, and keeps reads
+	// out of a checkout while it is reset. gmu serializes the git commands
+	// that clone, update or delete refs, and umu guards gitUrl, urlSource
+	// and origin.
 	rmu sync.RWMutex
+	gmu sync.Mutex
+	umu sync.Mutex
 }
 
+// gitBranch is a cached checkout of a single ref. Besides branches, the ref
+// can be a tag or a commit SHA, both of which are cached as immutable
+// snapshots that are never fetched again. sha is the commit the checkout is
+// at, lastChecked when the remote was last compared with it, and lastFetched
+// when the checkout was last cloned or updated. trees maps the directories
+// read at sha to the object IDs of their files, and objects the paths
+// stat'ed at sha to their info. readers counts the requests using the
+// branch, which keep it from being deleted.
 type gitBranch struct {
 	repo         *gitRepo
 	name         string
 	path         string
+	kind         refKind
 	cached       bool
+	sha          string
 	lastAccessed time.Time
+	lastChecked  time.Time
+	lastFetched  time.Time
+	trees        map[string]map[string]string
+	objects      map[string]ObjectInfo
+	readers      int
+	size         int64
+	measured     bool
 }
 
 type repoBranchInfo struct {
-	hash   string
-	branch string
-	gitUrl string
+	hash                string
+	branch              string
+	gitUrl              string
+	kind                refKind
+	requiresCredentials bool
 }
 
 func NewGitCache(cfg *config.Config, ctx context.Context, manager GitCacheManager) *GitCache {
+	var cloneSlots chan struct{}
+	if cfg.MaxConcurrentClones > 0 {
+		cloneSlots = make(chan struct{}, cfg.MaxConcurrentClones)
+	}
+
+	var blobs *blobCache
+	if cfg.BlobCacheBytes > 0 {
+		blobs = newBlobCache(cfg.BlobCacheBytes, cfg.BlobCacheMaxObject)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
 	return &GitCache{
 		cfg:        cfg,
 		tokenCache: ccache.New(ccache.Configure().MaxSize(10000000)),
 		repos:      make(map[string]*gitRepo),
 		manager:    manager,
 		ctx:        ctx,
+		cancel:     cancel,
+		refreshes:  make(map[*gitBranch]*time.Timer),
+		flights:    newFlightGroup(),
+		cloneSlots: cloneSlots,
+		blobs:      blobs,
 	}
 }
 
-func (c *GitCache) GetFileBlob(hash, gitUrl, branch, filePath string) ([]byte, error) {
-	b, err := c.getBranch(hash, gitUrl, branch)
+// GetFileBlob reads the whole file into memory. OpenFile streams it instead.
+func (c *GitCache) GetFileBlob(ctx context.Context, hash, gitUrl, ref, filePath string) ([]byte, error) {
+	f, err := c.OpenFile(ctx, hash, gitUrl, ref, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return content, nil
+}
+
+// OpenFile returns a reader of the file, which the caller must close. The ref
+// isn't evicted until then.
+func (c *GitCache) OpenFile(ctx context.Context, hash, gitUrl, ref, filePath string) (io.ReadSeekCloser, error) {
+	b, err := c.acquireBranch(hash, gitUrl, ref)
 	if err != nil {
 		return nil, err
 	}
-	content, err := b.readFile(filePath)
+
+	f, err := b.openFile(ctx, filePath)
 	if err != nil {
+		b.release()
 		return nil, err
 	}
 
 	b.touch()
 
-	return content, nil
+	return &branchFile{ReadSeekCloser: f, branch: b}, nil
 }
 
-func (c *GitCache) ListDir(hash, gitUrl, branch, path string) ([]GitItem, error) {
-	b, err := c.getBranch(hash, gitUrl, branch)
+func (c *GitCache) ListDir(ctx context.Context, hash, gitUrl, ref, path string) ([]GitItem, error) {
+	var items []GitItem
+	err := c.WalkDir(ctx, hash, gitUrl, ref, path, ListOptions{}, func(item GitItem) error {
+		items = append(items, item)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return b.listDir(path)
+	return items, nil
+}
+
+// WalkDir calls fn for the items of the directory at path selected by opts,
+// in the order of git trees, until fn returns an error. fs.SkipAll stops the
+// walk without failing it.
+func (c *GitCache) WalkDir(ctx context.Context, hash, gitUrl, ref, path string, opts ListOptions, fn func(GitItem) error) error {
+	b, err := c.acquireBranch(hash, gitUrl, ref)
+	if err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.walkDir(ctx, path, opts, fn)
+}
+
+func (c *GitCache) RefStatus(ctx context.Context, hash, gitUrl, ref string) (RefStatus, error) {
+	b, err := c.acquireBranch(hash, gitUrl, ref)
+	if err != nil {
+		return RefStatus{}, err
+	}
+	defer b.release()
+
+	if err := b.cache(ctx); err != nil {
+		return RefStatus{}, err
+	}
+
+	b.touch()
+
+	return b.status(), nil
+}
+
+// StatPath returns the object ID and the last modification of the file or
+// directory at path, without reading it.
+func (c *GitCache) StatPath(ctx context.Context, hash, gitUrl, ref, path string) (ObjectInfo, error) {
+	b, err := c.acquireBranch(hash, gitUrl, ref)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer b.release()
+
+	return b.stat(ctx, path)
+}
+
+// BlobCacheStats returns the hit and miss counters and the usage of the
+// in-memory blob cache.
+func (c *GitCache) BlobCacheStats() BlobCacheStats {
+	if c.blobs == nil {
+		return BlobCacheStats{}
+	}
+	return c.blobs.stats()
+}
+
+func (c *GitCache) IsImmutableRef(hash, gitUrl, ref string) bool {
+	b, err := c.getBranch(hash, gitUrl, ref)
+	if err != nil {
+		return false
+	}
+
+	return b.isImmutable()
 }
 
 func (c *GitCache) getRepo(hash, gitUrl string) (*gitRepo, error) {
@@ -105,8 +334,11 @@ func (c *GitCache) getRepo(hash, gitUrl string) (*gitRepo, error) {
 
 		r = c.newRepo(c, hash, gitUrl)
 		c.repos[hash] = r
+		return r, nil
 	}
 
+	r.refreshCredentials(gitUrl)
+
 	return r, nil
 }
 
@@ -119,6 +351,34 @@ func (c *GitCache) getBranch(hash, gitUrl, branch string) (*gitBranch, error) {
 	return repo.getBranch(branch)
 }
 
+// acquireBranch returns the branch for a request, which holds it until
+// release so that it can't be deleted while being read.
+func (c *GitCache) acquireBranch(hash, gitUrl, branch string) (*gitBranch, error) {
+	repo, err := c.getRepo(hash, gitUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.rmu.Lock()
+	defer repo.rmu.Unlock()
+
+	b, ok := repo.branches[branch]
+	if !ok {
+		b = repo.newBranch(branch)
+		repo.branches[branch] = b
+	}
+	b.readers++
+
+	return b, nil
+}
+
+func (b *gitBranch) release() {
+	b.repo.rmu.Lock()
+	defer b.repo.rmu.Unlock()
+
+	b.readers--
+}
+
 func (c *GitCache) newRepo(cache *GitCache, hash, gitUrl string) *gitRepo {
 	return &gitRepo{
 		cache:    cache,
@@ -145,6 +405,143 @@ func (r *gitRepo) getBranch(branch string) (*gitBranch, error) {
 	return b, nil
 }
 
+// refreshCredentials replaces the credentials of the repo with those of
+// gitUrl. This restores the credentials of a repo that was discovered on
+// disk, where only the URL without credentials is kept, and renews those
+// that expire.
+func (r *gitRepo) refreshCredentials(gitUrl string) {
+	if r.url() == gitUrl || !newGitRemote(gitUrl).hasCredentials() {
+		return
+	}
+
+	r.umu.Lock()
+	defer r.umu.Unlock()
+
+	r.gitUrl = gitUrl
+}
+
+// SetURLSource has the repo's URL renewed by source whenever git reaches the
+// remote, so that background checks and webhook fetches don't run with
+// credentials that have expired since the repo was last requested.
+func (c *GitCache) SetURLSource(hash, gitUrl string, source URLSource) error {
+	r, err := c.getRepo(hash, gitUrl)
+	if err != nil {
+		return err
+	}
+
+	r.umu.Lock()
+	defer r.umu.Unlock()
+
+	r.urlSource = source
+
+	return nil
+}
+
+// SetOrigin records where the repo was requested from, which the index keeps
+// so the repos on disk can be told apart without their URLs.
+func (c *GitCache) SetOrigin(hash, gitUrl string, origin Origin) error {
+	r, err := c.getRepo(hash, gitUrl)
+	if err != nil {
+		return err
+	}
+
+	r.umu.Lock()
+	defer r.umu.Unlock()
+
+	r.origin = origin
+
+	return nil
+}
+
+// renewCredentials asks the URL source of the repo, if it has one, for
+// current credentials.
+func (r *gitRepo) renewCredentials() {
+	r.umu.Lock()
+	source := r.urlSource
+	r.umu.Unlock()
+
+	if source != nil {
+		r.refreshCredentials(source())
+	}
+}
+
+func (r *gitRepo) url() string {
+	r.umu.Lock()
+	defer r.umu.Unlock()
+
+	return r.gitUrl
+}
+
+func (r *gitRepo) hasCredentials() bool {
+	return newGitRemote(r.url()).hasCredentials()
+}
+
+func (r *gitRepo) remote() *gitRemote {
+	r.renewCredentials()
+
+	gitUrl := r.url()
+	remote := newGitRemote(gitUrl, r.cache.remoteSettings()...)
+	remote.env = sshEnv(r.cache.cfg, gitUrl)
+	return remote
+}
+
+// remoteSettings returns the git configuration that applies to every remote,
+// which makes git trust the CA bundles of configured GitHub instances.
+func (c *GitCache) remoteSettings() []gitSetting {
+	var settings []gitSetting
+	for _, instance := range c.cfg.GithubInstances {
+		if instance.CABundle != "" && instance.CloneURL != "" {
+			settings = append(settings, gitSetting{
+				Key:   fmt.Sprintf("http.%s/.sslCAInfo", strings.TrimSuffix(instance.CloneURL, "/")),
+				Value: instance.CABundle,
+			})
+		}
+	}
+	return settings
+}
+
+func (r *gitRepo) storePath() string {
+	return path.Join(r.path, storeDir)
+}
+
+// retryTime returns when a repo that keeps failing to update is checked
+// again, and whether that is still in the future.
+func (r *gitRepo) retryTime() (time.Time, bool) {
+	r.rmu.RLock()
+	defer r.rmu.RUnlock()
+
+	return r.retryAt, time.Now().Before(r.retryAt)
+}
+
+// recordFailure backs off the checks of the repo, doubling the wait from one
+// check interval after every failure in a row, up to the maximum backoff.
+func (r *gitRepo) recordFailure() {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	maxBackoff := r.cache.cfg.UpdateMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxUpdateBackoff
+	}
+
+	backoff := r.cache.cfg.RepoCheckInterval
+	for i := 0; i < r.failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+
+	r.failures++
+	r.retryAt = time.Now().Add(backoff)
+}
+
+func (r *gitRepo) recordSuccess() {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	r.failures = 0
+	r.retryAt = time.Time{}
+}
+
 func (r *gitRepo) delete() error {
 	r.rmu.Lock()
 	defer r.rmu.Unlock()
@@ -154,6 +551,10 @@ func (r *gitRepo) delete() error {
 		return fmt.Errorf("failed to delete repo: %w", err)
 	}
 
+	if len(r.branches) > 0 {
+		return nil
+	}
+
 	r.cache.cmu.Lock()
 	defer r.cache.cmu.Unlock()
 
@@ -183,6 +584,29 @@ func (b *gitBranch) isCached() bool {
 	return b.repo.cache.manager.containsBranch(b)
 }
 
+func (b *gitBranch) isResolved() bool {
+	b.repo.rmu.RLock()
+	defer b.repo.rmu.RUnlock()
+
+	return b.kind != refUnknown
+}
+
+func (b *gitBranch) isImmutable() bool {
+	b.repo.rmu.RLock()
+	defer b.repo.rmu.RUnlock()
+
+	return b.kind == refTag || b.kind == refCommit
+}
+
+func (b *gitBranch) setKind(kind refKind) {
+	b.repo.rmu.Lock()
+	defer b.repo.rmu.Unlock()
+
+	if b.kind == refUnknown {
+		b.kind = kind
+	}
+}
+
 func (b *gitBranch) touch() {
 	b.repo.rmu.Lock()
 	defer b.repo.rmu.Unlock()
@@ -197,38 +621,170 @@ func (b *gitBranch) isExpired() bool {
 	return b.lastAccessed.Before(time.Now().Add(-b.repo.cache.cfg.RepoTTL))
 }
 
-func (b *gitBranch) cache() error {
-	if b.isCached() {
+// cache resolves the ref and clones it unless it is on disk already.
+// Concurrent callers share a single clone, and stop waiting for it when their
+// ctx is done.
+func (b *gitBranch) cache(ctx context.Context) error {
+	if b.isResolved() && b.isCached() {
 		return nil
 	}
 
-	b.repo.rmu.Lock()
-	defer b.repo.rmu.Unlock()
+	c := b.repo.cache
+	return c.flights.do(ctx, c.ctx, b.flightKey("clone"), func(ctx context.Context) error {
+		release, err := c.acquireCloneSlot(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
 
-	err := b.repo.cache.manager.cloneBranch(b)
-	if err != nil {
-		return fmt.Errorf("failed to clone branch: %w", err)
+		if err := b.clone(); err != nil {
+			return err
+		}
+
+		if c.cfg.MaxStorageBytes > 0 {
+			go c.enforceQuota()
+		}
+
+		return nil
+	})
+}
+
+// clone runs the git commands without holding the repo lock, so that the
+// other branches of the repo can be read in the meantime.
+func (b *gitBranch) clone() error {
+	b.repo.gmu.Lock()
+	defer b.repo.gmu.Unlock()
+
+	if !b.isResolved() {
+		kind, err := b.repo.cache.manager.resolveRef(b)
+		if err != nil {
+			return fmt.Errorf("failed to resolve ref: %w", err)
+		}
+		b.setKind(kind)
 	}
 
-	b.cached = true
+	cloned := false
+	if !b.isCached() {
+		err := b.repo.cache.manager.cloneBranch(b)
+		if err != nil {
+			return fmt.Errorf("failed to clone branch: %w", err)
+		}
+		cloned = true
+	}
+
+	b.repo.rmu.Lock()
+	if !b.cached {
+		b.cached = true
+		b.recordHead()
+	}
+	if cloned {
+		b.lastFetched = b.lastChecked
+	}
+	b.repo.rmu.Unlock()
+
+	b.measure()
 
 	return nil
 }
 
-func (b *gitBranch) update() error {
-	if !b.isCached() {
-		return nil
+// recordHead stores the commit the checkout is at. The caller holds the repo
+// lock.
+func (b *gitBranch) recordHead() {
+	sha, err := b.repo.cache.manager.headSHA(b)
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to record head of %s/%s: %v", b.repo.hash, b.name, err))
 	}
 
+	if sha != b.sha {
+		b.trees = nil
+		b.objects = nil
+	}
+	b.sha = sha
+	b.lastChecked = time.Now()
+}
+
+// isCurrent reports whether the checkout is at remoteSHA, and records the
+// check when it is. Branches rediscovered on disk read their head first.
+func (b *gitBranch) isCurrent(remoteSHA string) bool {
 	b.repo.rmu.Lock()
 	defer b.repo.rmu.Unlock()
 
-	err := b.repo.cache.manager.updateBranch(b)
-	if err != nil {
-		return fmt.Errorf("failed to update branch: %w", err)
+	if b.sha == "" && b.repo.cache.manager.containsBranch(b) {
+		b.recordHead()
 	}
 
-	return nil
+	if b.sha == "" || b.sha != remoteSHA {
+		return false
+	}
+
+	b.lastChecked = time.Now()
+	return true
+}
+
+func (b *gitBranch) status() RefStatus {
+	b.repo.rmu.RLock()
+	defer b.repo.rmu.RUnlock()
+
+	return RefStatus{
+		Ref:         b.name,
+		Kind:        b.kind.String(),
+		Commit:      b.sha,
+		LastChecked: b.lastChecked,
+	}
+}
+
+// update fetches the branch, sharing the fetch with concurrent updates of
+// the same branch.
+func (b *gitBranch) update(ctx context.Context) error {
+	if !b.isCached() || b.isImmutable() {
+		return nil
+	}
+
+	return b.repo.cache.flights.do(ctx, ctx, b.flightKey("fetch"), func(ctx context.Context) error {
+		b.repo.gmu.Lock()
+		defer b.repo.gmu.Unlock()
+
+		// The fetch only writes the store, which gmu guards, so requests
+		// keep reading the branch until the reset moves it.
+		if err := b.repo.cache.manager.updateBranch(ctx, b); err != nil {
+			return fmt.Errorf("failed to update branch: %w", err)
+		}
+
+		b.repo.rmu.Lock()
+		err := b.repo.cache.manager.resetBranch(ctx, b)
+		if err == nil {
+			b.recordHead()
+			b.lastFetched = b.lastChecked
+		}
+		b.repo.rmu.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("failed to update branch: %w", err)
+		}
+
+		b.measure()
+
+		return nil
+	})
+}
+
+func (b *gitBranch) flightKey(op string) string {
+	return op + ":" + b.repo.hash + "/" + b.name
+}
+
+// acquireCloneSlot waits until fewer than max-concurrent-clones clones run,
+// and returns the function that frees the slot.
+func (c *GitCache) acquireCloneSlot(ctx context.Context) (func(), error) {
+	if c.cloneSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case c.cloneSlots <- struct{}{}:
+		return func() { <-c.cloneSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func (b *gitBranch) delete() error {
@@ -236,9 +792,21 @@ func (b *gitBranch) delete() error {
 		return nil
 	}
 
+	b.repo.gmu.Lock()
+	defer b.repo.gmu.Unlock()
+
+	// Requests acquire branches under the repo lock, so none can start
+	// reading the branch once it is out of the map.
 	b.repo.rmu.Lock()
-	defer func() {
+	if b.readers > 0 {
 		b.repo.rmu.Unlock()
+		return errBranchInUse
+	}
+	delete(b.repo.branches, b.name)
+	b.cached = false
+	b.repo.rmu.Unlock()
+
+	defer func() {
 		err := b.repo.delete()
 		if err != nil {
 			logger.Error(fmt.Sprintf("failed to delete repo: %v", err))
@@ -250,35 +818,159 @@ func (b *gitBranch) delete() error {
 		return fmt.Errorf("failed to delete branch: %w", err)
 	}
 
-	delete(b.repo.branches, b.name)
-
 	return nil
 }
 
-func (b *gitBranch) readFile(filePath string) ([]byte, error) {
-	if err := b.cache(); err != nil {
+// openFile serves blobs small enough for the blob cache from memory, and
+// streams the others.
+func (b *gitBranch) openFile(ctx context.Context, filePath string) (io.ReadSeekCloser, error) {
+	if err := b.cache(ctx); err != nil {
 		return nil, err
 	}
 
-	return b.repo.cache.manager.readFile(b, filePath)
+	blobs := b.repo.cache.blobs
+	if blobs == nil {
+		f, _, err := b.repo.cache.manager.openFile(b, filePath)
+		return f, err
+	}
+
+	id, ok := b.blobID(filePath)
+	if ok {
+		if content, ok := blobs.get(id); ok {
+			return newMemoryFile(content), nil
+		}
+	}
+
+	f, size, err := b.repo.cache.manager.openFile(b, filePath)
+	if err != nil || !ok || size > blobs.maxObject {
+		return f, err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	// The checkout may have moved since the ID was looked up.
+	if blobObjectID(content, len(id)) == id {
+		blobs.add(id, content)
+	}
+
+	return newMemoryFile(content), nil
 }
 
-func (b *gitBranch) listDir(dirPath string) ([]GitItem, error) {
-	if err := b.cache(); err != nil {
-		return nil, err
+// blobID returns the object ID of the file at filePath in the commit the
+// branch is at. The IDs of a directory are listed once per commit, so a
+// branch that moves looks its files up again.
+func (b *gitBranch) blobID(filePath string) (string, bool) {
+	dir, name := path.Split(strings.Trim(path.Clean("/"+filePath), "/"))
+	dir = strings.TrimSuffix(dir, "/")
+
+	b.repo.rmu.RLock()
+	commit := b.sha
+	ids, ok := b.trees[dir]
+	b.repo.rmu.RUnlock()
+
+	if commit == "" || name == "" {
+		return "", false
+	}
+
+	if !ok {
+		var err error
+		ids, err = b.repo.cache.manager.blobIDs(b, commit, dir)
+		if err != nil || ids == nil {
+			return "", false
+		}
+
+		b.repo.rmu.Lock()
+		if b.sha == commit {
+			if b.trees == nil {
+				b.trees = make(map[string]map[string]string)
+			}
+			b.trees[dir] = ids
+		}
+		b.repo.rmu.Unlock()
+	}
+
+	id, ok := ids[name]
+	return id, ok
+}
+
+// stat looks the object at objectPath up in the commit the branch is at.
+// Lookups are kept until the branch moves. Paths that can't be looked up get
+// an empty info, so that reading them reports the actual error.
+func (b *gitBranch) stat(ctx context.Context, objectPath string) (ObjectInfo, error) {
+	if err := b.cache(ctx); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	objectPath, ok := cleanObjectPath(objectPath)
+	if !ok {
+		return ObjectInfo{}, nil
+	}
+
+	b.repo.rmu.RLock()
+	commit := b.sha
+	info, ok := b.objects[objectPath]
+	b.repo.rmu.RUnlock()
+
+	if ok || commit == "" {
+		return info, nil
+	}
+
+	manager := b.repo.cache.manager
+	objectType, id, err := manager.objectID(b, commit, objectPath)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat %s: %w", objectPath, err)
+	}
+	if id == "" {
+		return ObjectInfo{}, nil
+	}
+
+	modified, err := manager.lastModified(b, commit, objectPath)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed to read last modification of %s/%s:%s: %v", b.repo.hash, b.name, objectPath, err))
+	}
+
+	if objectType == "tree" {
+		objectType = "dir"
+	}
+	info = ObjectInfo{Type: objectType, Hash: id, Commit: commit, LastModified: modified}
+
+	b.repo.rmu.Lock()
+	if b.sha == commit {
+		if b.objects == nil {
+			b.objects = make(map[string]ObjectInfo)
+		}
+		b.objects[objectPath] = info
+	}
+	b.repo.rmu.Unlock()
+
+	return info, nil
+}
+
+func (b *gitBranch) walkDir(ctx context.Context, dirPath string, opts ListOptions, fn func(GitItem) error) error {
+	after, err := decodeCursor(opts.After)
+	if err != nil {
+		return err
+	}
+
+	if err := b.cache(ctx); err != nil {
+		return err
 	}
 
 	if dirPath[:1] == "/" {
 		dirPath = dirPath[1:]
 	}
 
-	contents, err := b.repo.cache.manager.listTree(b, dirPath)
+	listing, err := b.repo.cache.manager.listTree(b, dirPath, opts.Recursive, !opts.OmitSizes)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer listing.Close()
 
-	var items []GitItem
-	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner := bufio.NewScanner(listing)
 	for scanner.Scan() {
 		line := scanner.Text()
 		parts := strings.SplitN(line, "\t", 2)
@@ -293,7 +985,7 @@ func (b *gitBranch) listDir(dirPath string) ([]GitItem, error) {
 		}
 		itemType := metaParts[1]
 		hash := metaParts[2]
-		var size int64 = 0
+		var size int64
 
 		if itemType == "blob" && len(metaParts) >= 4 {
 			s, err := strconv.ParseInt(metaParts[3], 10, 64)
@@ -304,13 +996,28 @@ func (b *gitBranch) listDir(dirPath string) ([]GitItem, error) {
 			itemType = "dir"
 		}
 
-		items = append(items, GitItem{
+		item := GitItem{
 			Hash: hash,
 			Path: filePath,
 			Type: itemType,
-			Size: size,
-		})
+		}
+		if !opts.OmitSizes {
+			item.Size = &size
+		}
+		if !opts.matches(item, parts[1]) || (after != "" && item.sortKey() <= after) {
+			continue
+		}
+
+		if err := fn(item); err != nil {
+			if err == fs.SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read tree listing: %w", err)
 	}
 
-	return items, nil
+	return listing.Close()
 }
@@ -2,10 +2,12 @@ package gitcache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/costinul/git-rest-cache/logger"
@@ -16,8 +18,14 @@ func (c *GitCache) Start() error {
 		return fmt.Errorf("invalid settings: %w", err)
 	}
 
+	if err := c.loadIndex(); err != nil {
+		logger.Error(fmt.Sprintf("failed to load index, access times of cached refs start over: %v", err))
+	}
+
 	started := make(chan struct{})
+	c.stopped = make(chan struct{})
 	go func() {
+		defer close(c.stopped)
 		c.setRunning(true)
 		close(started)
 		if err := c.startRepoCheck(); err != nil {
@@ -37,8 +45,13 @@ func (c *GitCache) Stop() {
 	if !c.IsRunning() {
 		return
 	}
-	c.ctx.Done()
+	c.cancel()
+	<-c.stopped
 	c.tokenCache.Stop()
+
+	if err := c.saveIndex(); err != nil {
+		logger.Error(fmt.Sprintf("failed to save index: %v", err))
+	}
 }
 
 func (c *GitCache) setRunning(running bool) {
@@ -80,33 +93,143 @@ func (c *GitCache) startRepoCheck() error {
 	}
 }
 
+// checkRepos updates the cached branches that moved on their remote, and
+// deletes the expired ones. Repos are checked by a pool of workers, and a
+// failing repo only delays its own branches: its error is logged, and it is
+// retried with an exponential backoff.
 func (c *GitCache) checkRepos() error {
 	branches, err := c.manager.getCachedRepoBranches(c.cfg.StorageFolder)
 	if err != nil {
 		return fmt.Errorf("failed to get cached repo branches: %w", err)
 	}
 
+	// Branches still to check, grouped by repo so that a single ls-remote
+	// covers all the branches of a repo.
+	var repos []*gitRepo
+	pending := make(map[*gitRepo][]*gitBranch)
+	backingOff := make(map[*gitRepo]bool)
+
 	for _, branch := range branches {
 		b, err := c.getBranch(branch.hash, branch.gitUrl, branch.branch)
 		if err != nil {
-			return fmt.Errorf("failed to get repo from cache: %w", err)
+			logger.Error(fmt.Sprintf("failed to get %s/%s from cache: %v", branch.hash, branch.branch, err))
+			continue
 		}
+		b.setKind(branch.kind)
 
 		if c.cfg.RepoTTL > 0 && b.isExpired() {
-			err = b.delete()
-			if err != nil {
-				return fmt.Errorf("failed to delete repo: %w", err)
+			if err := b.delete(); err != nil && !errors.Is(err, errBranchInUse) {
+				logger.Error(fmt.Sprintf("failed to delete %s/%s: %v", branch.hash, branch.branch, err))
 			}
 			continue
 		}
 
-		err = b.update()
+		if branch.requiresCredentials && !b.repo.hasCredentials() {
+			logger.Debug(fmt.Sprintf("skipping update of %s/%s until a request provides credentials", branch.hash, branch.branch))
+			continue
+		}
+
+		if b.isImmutable() {
+			continue
+		}
+
+		if _, ok := pending[b.repo]; !ok {
+			if backingOff[b.repo] {
+				continue
+			}
+			if retryAt, ok := b.repo.retryTime(); ok {
+				logger.Debug(fmt.Sprintf("skipping update of %s until %s after repeated failures", branch.hash, retryAt.Format(time.RFC3339)))
+				backingOff[b.repo] = true
+				continue
+			}
+			repos = append(repos, b.repo)
+		}
+		pending[b.repo] = append(pending[b.repo], b)
+	}
+
+	workers := c.cfg.UpdateWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *gitRepo)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				c.checkRepo(r, pending[r])
+			}
+		}()
+	}
+
+queue:
+	for _, r := range repos {
+		select {
+		case jobs <- r:
+		case <-c.ctx.Done():
+			break queue
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	c.enforceQuota()
+
+	if err := c.saveIndex(); err != nil {
+		logger.Error(fmt.Sprintf("failed to save index: %v", err))
+	}
+
+	return c.ctx.Err()
+}
+
+// checkRepo compares branches with their remote and updates those that moved.
+// Every remote operation runs under its own update timeout.
+func (c *GitCache) checkRepo(r *gitRepo, branches []*gitBranch) {
+	names := make([]string, 0, len(branches))
+	for _, b := range branches {
+		names = append(names, b.name)
+	}
+
+	ctx, cancel := c.updateContext()
+	heads, err := c.manager.remoteHeads(ctx, r, names)
+	cancel()
+	if err != nil {
+		logger.Error(fmt.Sprintf("failed to check %s: %v", r.hash, err))
+		r.recordFailure()
+		return
+	}
+
+	failed := false
+	for _, b := range branches {
+		if b.isCurrent(heads[b.name]) {
+			continue
+		}
+
+		ctx, cancel := c.updateContext()
+		err := b.update(ctx)
+		cancel()
 		if err != nil {
-			return fmt.Errorf("failed to update repo: %w", err)
+			logger.Error(fmt.Sprintf("failed to update %s/%s: %v", r.hash, b.name, err))
+			failed = true
 		}
 	}
 
-	return nil
+	if failed {
+		r.recordFailure()
+	} else {
+		r.recordSuccess()
+	}
+}
+
+// updateContext returns the context a background update of a remote runs
+// under.
+func (c *GitCache) updateContext() (context.Context, context.CancelFunc) {
+	if c.cfg.UpdateTimeout <= 0 {
+		return context.WithCancel(c.ctx)
+	}
+	return context.WithTimeout(c.ctx, c.cfg.UpdateTimeout)
 }
 
 func getGitURL(path string) (string, error) {
@@ -127,5 +250,14 @@ func (c *GitCache) verifySettings() error {
 			c.cfg.RepoCheckInterval, c.cfg.RepoTTL)
 	}
 
+	if len(c.cfg.SSHKeys) > 0 {
+		if c.cfg.SSHKnownHosts == "" {
+			return fmt.Errorf("ssh-keys require ssh-known-hosts, so that SSH hosts are verified before a deploy key is offered")
+		}
+		if _, err := os.Stat(c.cfg.SSHKnownHosts); err != nil {
+			return fmt.Errorf("failed to read ssh-known-hosts: %w", err)
+		}
+	}
+
 	return nil
 }
@@ -3,7 +3,9 @@ package gitcache
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -63,7 +65,11 @@ func (m *mockGitManager) cloneBranch(branch *gitBranch) error {
 	return nil
 }
 
-func (m *mockGitManager) readFile(branch *gitBranch, filePath string) ([]byte, error) {
+func (m *mockGitManager) resolveRef(branch *gitBranch) (refKind, error) {
+	return refBranch, nil
+}
+
+func (m *mockGitManager) openFile(branch *gitBranch, filePath string) (io.ReadSeekCloser, int64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -71,9 +77,9 @@ func (m *mockGitManager) readFile(branch *gitBranch, filePath string) ([]byte, e
 	m.getCount++ // Increment counter
 	content, err := m.getContent(branch.repo.hash, branch.name)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return []byte(content.content), nil
+	return newMemoryFile([]byte(content.content)), int64(len(content.content)), nil
 }
 
 func (m *mockGitManager) containsBranch(branch *gitBranch) bool {
@@ -117,7 +123,7 @@ func (m *mockGitManager) getCachedRepoBranches(repoPath string) ([]repoBranchInf
 	return branches, nil
 }
 
-func (m *mockGitManager) updateBranch(branch *gitBranch) error {
+func (m *mockGitManager) updateBranch(ctx context.Context, branch *gitBranch) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -127,14 +133,58 @@ func (m *mockGitManager) updateBranch(branch *gitBranch) error {
 	return nil
 }
 
+func (m *mockGitManager) resetBranch(ctx context.Context, branch *gitBranch) error {
+	return nil
+}
+
+func (m *mockGitManager) headSHA(branch *gitBranch) (string, error) {
+	return "", nil
+}
+
+func (m *mockGitManager) blobIDs(branch *gitBranch, commit, dir string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (m *mockGitManager) objectID(branch *gitBranch, commit, objectPath string) (string, string, error) {
+	return "", "", nil
+}
+
+func (m *mockGitManager) lastModified(branch *gitBranch, commit, objectPath string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *mockGitManager) log(branch *gitBranch, commit, logPath string, opts LogOptions) ([]Commit, error) {
+	return nil, nil
+}
+
+func (m *mockGitManager) historyExtent(branch *gitBranch, commit string) (historyExtent, error) {
+	return historyExtent{}, nil
+}
+
+func (m *mockGitManager) deepen(ctx context.Context, branch *gitBranch, commits int) error {
+	return nil
+}
+
+func (m *mockGitManager) mergeBase(branch *gitBranch, base, head string) (string, bool, error) {
+	return base, true, nil
+}
+
+func (m *mockGitManager) diff(branch *gitBranch, base, head string, patch bool) ([]FileChange, error) {
+	return []FileChange{}, nil
+}
+
+func (m *mockGitManager) remoteHeads(ctx context.Context, repo *gitRepo, branches []string) (map[string]string, error) {
+	return nil, nil
+}
+
 func (m *mockGitManager) getCallCount() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	return m.getCount
 }
 
-func (m *mockGitManager) listTree(branch *gitBranch, path string) ([]byte, error) {
-	return nil, nil
+func (m *mockGitManager) listTree(branch *gitBranch, path string, recursive, sizes bool) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
 }
 
 func TestGitCacheBasicFlow(t *testing.T) {
@@ -158,7 +208,7 @@ func TestGitCacheBasicFlow(t *testing.T) {
 	filePath := "test.txt"
 	repoHash := mockRepoHash(gitUrl)
 
-	content1, err := cache.GetFileBlob(repoHash, gitUrl, branch, filePath)
+	content1, err := cache.GetFileBlob(context.Background(), repoHash, gitUrl, branch, filePath)
 	assert.NoError(t, err, "Failed initial GetFile")
 
 	expectedInitial := fmt.Sprintf("Initial content for %s/%s", gitUrl, branch)
@@ -166,7 +216,7 @@ func TestGitCacheBasicFlow(t *testing.T) {
 
 	time.Sleep(2000 * time.Millisecond)
 
-	content2, err := cache.GetFileBlob(repoHash, gitUrl, branch, filePath)
+	content2, err := cache.GetFileBlob(context.Background(), repoHash, gitUrl, branch, filePath)
 	assert.NoError(t, err, "Failed second GetFile")
 	assert.Equal(t, "Updated content", string(content2))
 
@@ -213,7 +263,7 @@ func TestGitCacheConcurrentAccess(t *testing.T) {
 
 			for j := 0; j < iterationsPerGoroutine; j++ {
 				repoHash := mockRepoHash(gitUrl)
-				content, err := cache.GetFileBlob(repoHash, gitUrl, branch, filePath)
+				content, err := cache.GetFileBlob(context.Background(), repoHash, gitUrl, branch, filePath)
 				if err != nil {
 					errors <- fmt.Errorf("goroutine %d iteration %d: %v", i, j, err)
 					return
@@ -0,0 +1,136 @@
+package gitcache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// minDeepen is the fewest commits a clone is deepened by at a time.
+const minDeepen = 50
+
+// LogOptions selects the commits of a history. Limit is the most commits
+// returned, and Since and Until, when set, bound their commit dates.
+type LogOptions struct {
+	Limit int
+	Since time.Time
+	Until time.Time
+}
+
+// historyExtent is the part of the history of a commit that a store has: the
+// number of commits, whether older ones were left out by a shallow clone, and
+// the date of the oldest.
+type historyExtent struct {
+	commits   int
+	truncated bool
+	oldest    time.Time
+}
+
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+type Commit struct {
+	SHA       string    `json:"sha"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+	Parents   []string  `json:"parents"`
+}
+
+// CommitLog is the history of a path. Truncated is set when older commits
+// may exist that the clone wasn't deepened to, in which case the oldest
+// commit returned shows no parents.
+type CommitLog struct {
+	Commits   []Commit `json:"commits"`
+	Truncated bool     `json:"truncated"`
+}
+
+// Log returns the commits that touched path, newest first, up to the commit
+// the ref is cached at. Shallow clones are deepened as needed, up to
+// max-history-depth commits.
+func (c *GitCache) Log(ctx context.Context, hash, gitUrl, ref, path string, opts LogOptions) (CommitLog, error) {
+	b, err := c.acquireBranch(hash, gitUrl, ref)
+	if err != nil {
+		return CommitLog{}, err
+	}
+	defer b.release()
+
+	history, err := b.log(ctx, path, opts)
+	if err != nil {
+		return CommitLog{}, err
+	}
+
+	b.touch()
+
+	return history, nil
+}
+
+// log reads the history at hand, and deepens the clone while it has fewer
+// commits than asked for and more of them may exist. Each deepening at least
+// doubles the depth, so that rarely changed paths take few fetches.
+func (b *gitBranch) log(ctx context.Context, logPath string, opts LogOptions) (CommitLog, error) {
+	if err := b.cache(ctx); err != nil {
+		return CommitLog{}, err
+	}
+
+	logPath, ok := cleanObjectPath(logPath)
+	if !ok {
+		return CommitLog{}, ErrFileNotFound
+	}
+
+	b.repo.rmu.RLock()
+	commit := b.sha
+	b.repo.rmu.RUnlock()
+
+	manager := b.repo.cache.manager
+	maxDepth := b.repo.cache.cfg.MaxHistoryDepth
+	for {
+		commits, err := manager.log(b, commit, logPath, opts)
+		if err != nil {
+			return CommitLog{}, err
+		}
+		if opts.Limit > 0 && len(commits) >= opts.Limit {
+			return CommitLog{Commits: commits}, nil
+		}
+
+		extent, err := manager.historyExtent(b, commit)
+		if err != nil {
+			return CommitLog{}, err
+		}
+
+		// Older commits can't be in the range once the oldest at hand is
+		// before it.
+		if !opts.Since.IsZero() && extent.oldest.Before(opts.Since) {
+			return CommitLog{Commits: commits}, nil
+		}
+		if !extent.truncated || extent.commits >= maxDepth {
+			return CommitLog{Commits: commits, Truncated: extent.truncated}, nil
+		}
+
+		deepened, err := b.deepen(ctx, commit, min(max(extent.commits, minDeepen), maxDepth-extent.commits))
+		if err != nil {
+			return CommitLog{}, err
+		}
+		if deepened.commits <= extent.commits {
+			return CommitLog{Commits: commits, Truncated: deepened.truncated}, nil
+		}
+	}
+}
+
+// deepen fetches older commits of the branch, and returns the part of the
+// history of commit then at hand.
+func (b *gitBranch) deepen(ctx context.Context, commit string, commits int) (historyExtent, error) {
+	b.repo.gmu.Lock()
+	defer b.repo.gmu.Unlock()
+
+	if err := b.repo.cache.manager.deepen(ctx, b, commits); err != nil {
+		return historyExtent{}, fmt.Errorf("failed to deepen history: %w", err)
+	}
+
+	b.measure()
+
+	return b.repo.cache.manager.historyExtent(b, commit)
+}
@@ -0,0 +1,93 @@
+package gitcache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// commitAt commits a file with the given author and committer date.
+func (r *testRemote) commitAt(file, content string, date time.Time) string {
+	require.NoError(r.t, os.WriteFile(filepath.Join(r.path, file), []byte(content), 0644))
+	r.git("add", file)
+
+	cmd := exec.Command("git", "-C", r.path, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "update "+file)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date.Format(time.RFC3339), "GIT_COMMITTER_DATE="+date.Format(time.RFC3339))
+	output, err := cmd.CombinedOutput()
+	require.NoError(r.t, err, "git commit: %s", output)
+
+	return r.git("rev-parse", "HEAD")
+}
+
+func TestLog(t *testing.T) {
+	remote := newTestRemote(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var shas []string
+	for i := 0; i < 6; i++ {
+		file := []string{"a.txt", "b.txt"}[i%2]
+		shas = append(shas, remote.commitAt(file, fmt.Sprint(i), start.AddDate(0, 0, i)))
+	}
+
+	caches := map[string]*GitCache{
+		"worktree":     newTestDefaultCache(t),
+		"object-store": newTestObjectStoreCache(t),
+	}
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.cfg.MaxHistoryDepth = 1000
+			log := func(path string, opts LogOptions) CommitLog {
+				history, err := cache.Log(context.Background(), "log-repo", remote.url, "main", path, opts)
+				require.NoError(t, err)
+				return history
+			}
+			commitSHAs := func(history CommitLog) []string {
+				var result []string
+				for _, commit := range history.Commits {
+					result = append(result, commit.SHA)
+				}
+				return result
+			}
+
+			// The clone is deepened to serve the whole history.
+			history := log("/a.txt", LogOptions{})
+			assert.Equal(t, []string{shas[4], shas[2], shas[0]}, commitSHAs(history))
+			assert.False(t, history.Truncated)
+
+			first := history.Commits[0]
+			assert.Equal(t, "update a.txt", first.Message)
+			assert.Equal(t, "test", first.Author.Name)
+			assert.Equal(t, "test@example.com", first.Committer.Email)
+			assert.True(t, start.AddDate(0, 0, 4).Equal(first.Committer.Date))
+			assert.Equal(t, []string{shas[3]}, first.Parents)
+			assert.Empty(t, history.Commits[2].Parents)
+
+			assert.Equal(t, []string{shas[5], shas[4]}, commitSHAs(log("/", LogOptions{Limit: 2})))
+			assert.Equal(t, []string{shas[5], shas[3]}, commitSHAs(log("/b.txt", LogOptions{Since: start.AddDate(0, 0, 2)})))
+			assert.Equal(t, []string{shas[1]}, commitSHAs(log("/b.txt", LogOptions{Until: start.AddDate(0, 0, 2)})))
+			assert.Empty(t, log("/missing.txt", LogOptions{}).Commits)
+		})
+	}
+}
+
+func TestLogStopsAtMaxHistoryDepth(t *testing.T) {
+	remote := newTestRemote(t)
+	for i := 0; i < 5; i++ {
+		remote.commit("a.txt", fmt.Sprint(i))
+	}
+
+	cache := newTestObjectStoreCache(t)
+	cache.cfg.MaxHistoryDepth = 2
+
+	history, err := cache.Log(context.Background(), "log-repo", remote.url, "main", "/", LogOptions{})
+	require.NoError(t, err)
+	assert.Len(t, history.Commits, 2)
+	assert.True(t, history.Truncated)
+}
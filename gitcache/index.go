@@ -0,0 +1,178 @@
+package gitcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/costinul/git-rest-cache/logger"
+)
+
+// indexFile keeps the metadata of the cached branches across restarts. Dot
+// entries of the storage folder are never mistaken for repos.
+const indexFile = ".index.json"
+
+const indexVersion = 1
+
+type cacheIndex struct {
+	Version int         `json:"version"`
+	Repos   []repoIndex `json:"repos"`
+}
+
+// repoIndex is the metadata of a cached repo. Origin is the URL the repo was
+// cloned from, without credentials, Provider and Repo the provider and path it
+// was requested through, and StoreSize the disk usage of its store.
+type repoIndex struct {
+	Hash      string        `json:"hash"`
+	Origin    string        `json:"origin"`
+	Provider  string        `json:"provider,omitempty"`
+	Repo      string        `json:"repo,omitempty"`
+	StoreSize int64         `json:"store_size"`
+	Branches  []branchIndex `json:"branches"`
+}
+
+type branchIndex struct {
+	Ref          string    `json:"ref"`
+	Kind         string    `json:"kind"`
+	Commit       string    `json:"commit,omitempty"`
+	Size         int64     `json:"size"`
+	LastAccessed time.Time `json:"last_accessed"`
+	LastChecked  time.Time `json:"last_checked"`
+	LastFetched  time.Time `json:"last_fetched"`
+}
+
+func (c *GitCache) indexPath() string {
+	return filepath.Join(c.cfg.StorageFolder, indexFile)
+}
+
+// saveIndex writes the metadata of the branches in memory to the index. The
+// file is replaced atomically, so a crash leaves the previous index intact.
+func (c *GitCache) saveIndex() error {
+	c.imu.Lock()
+	defer c.imu.Unlock()
+
+	c.cmu.RLock()
+	repos := make([]*gitRepo, 0, len(c.repos))
+	for _, r := range c.repos {
+		repos = append(repos, r)
+	}
+	c.cmu.RUnlock()
+
+	index := cacheIndex{Version: indexVersion, Repos: []repoIndex{}}
+	for _, r := range repos {
+		entry := repoIndex{Hash: r.hash, Origin: newGitRemote(r.url()).url}
+		r.umu.Lock()
+		entry.Provider = r.origin.Provider
+		entry.Repo = r.origin.Repo
+		r.umu.Unlock()
+
+		r.rmu.RLock()
+		entry.StoreSize = r.storeSize
+		for _, b := range r.branches {
+			if !b.cached {
+				continue
+			}
+			entry.Branches = append(entry.Branches, branchIndex{
+				Ref:          b.name,
+				Kind:         b.kind.String(),
+				Commit:       b.sha,
+				Size:         b.size,
+				LastAccessed: b.lastAccessed,
+				LastChecked:  b.lastChecked,
+				LastFetched:  b.lastFetched,
+			})
+		}
+		r.rmu.RUnlock()
+
+		if len(entry.Branches) == 0 {
+			continue
+		}
+		sort.Slice(entry.Branches, func(i, j int) bool { return entry.Branches[i].Ref < entry.Branches[j].Ref })
+		index.Repos = append(index.Repos, entry)
+	}
+	sort.Slice(index.Repos, func(i, j int) bool { return index.Repos[i].Hash < index.Repos[j].Hash })
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(c.cfg.StorageFolder, indexFile+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), c.indexPath()); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	return nil
+}
+
+// loadIndex restores the metadata of the branches that are still on disk, so
+// that their TTL and eviction order survive a restart.
+func (c *GitCache) loadIndex() error {
+	data, err := os.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var index cacheIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("failed to decode index: %w", err)
+	}
+	if index.Version != indexVersion {
+		logger.Warn(fmt.Sprintf("ignoring index of unsupported version %d", index.Version))
+		return nil
+	}
+
+	for _, entry := range index.Repos {
+		r := c.newRepo(c, entry.Hash, entry.Origin)
+		r.origin = Origin{Provider: entry.Provider, Repo: entry.Repo}
+		r.storeSize = entry.StoreSize
+
+		for _, branch := range entry.Branches {
+			b := r.newBranch(branch.Ref)
+			if !c.manager.containsBranch(b) {
+				continue
+			}
+
+			b.kind = parseRefKind(branch.Kind)
+			b.cached = true
+			b.sha = branch.Commit
+			b.size = branch.Size
+			b.measured = true
+			b.lastAccessed = branch.LastAccessed
+			b.lastChecked = branch.LastChecked
+			b.lastFetched = branch.LastFetched
+			r.branches[b.name] = b
+		}
+
+		if len(r.branches) == 0 {
+			continue
+		}
+
+		c.cmu.Lock()
+		if _, ok := c.repos[r.hash]; !ok {
+			c.repos[r.hash] = r
+		}
+		c.cmu.Unlock()
+	}
+
+	return nil
+}
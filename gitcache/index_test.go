@@ -0,0 +1,76 @@
+package gitcache
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexSurvivesRestart(t *testing.T) {
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           time.Hour,
+		RepoCheckInterval: time.Minute,
+	}
+
+	remotes := map[string]*testRemote{}
+	cache := NewGitCache(cfg, context.Background(), &DefaultGitManager{})
+	for _, hash := range []string{"kept", "stale"} {
+		remotes[hash] = newTestRemote(t)
+		remotes[hash].commit("file.txt", hash)
+		_, err := cache.GetFileBlob(context.Background(), hash, remotes[hash].url, "main", "file.txt")
+		require.NoError(t, err)
+	}
+	require.NoError(t, cache.SetOrigin("kept", remotes["kept"].url, Origin{Provider: "github", Repo: "corp/kept"}))
+
+	accessed := map[string]time.Time{
+		"kept":  time.Now().Add(-10 * time.Minute).Round(0),
+		"stale": time.Now().Add(-2 * time.Hour).Round(0),
+	}
+	for hash, at := range accessed {
+		cache.repos[hash].branches["main"].lastAccessed = at
+	}
+	kept := *cache.repos["kept"].branches["main"]
+
+	require.NoError(t, cache.saveIndex())
+
+	data, err := os.ReadFile(filepath.Join(cfg.StorageFolder, indexFile))
+	require.NoError(t, err)
+	var index cacheIndex
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Repos, 2)
+	assert.Equal(t, remotes["kept"].url, index.Repos[0].Origin)
+	assert.Equal(t, "github", index.Repos[0].Provider)
+	assert.Equal(t, "corp/kept", index.Repos[0].Repo)
+	assert.Empty(t, index.Repos[1].Provider)
+
+	restarted := NewGitCache(cfg, context.Background(), &DefaultGitManager{})
+	require.NoError(t, restarted.loadIndex())
+
+	assert.Equal(t, Origin{Provider: "github", Repo: "corp/kept"}, restarted.repos["kept"].origin)
+	restored := restarted.repos["kept"].branches["main"]
+	assert.True(t, kept.lastAccessed.Equal(restored.lastAccessed))
+	assert.True(t, kept.lastFetched.Equal(restored.lastFetched))
+	assert.False(t, restored.lastFetched.IsZero())
+	assert.Equal(t, kept.sha, restored.sha)
+	assert.Equal(t, kept.size, restored.size)
+	assert.Equal(t, refBranch, restored.kind)
+
+	require.NoError(t, restarted.checkRepos())
+	assert.DirExists(t, filepath.Join(cfg.StorageFolder, "kept"))
+	assert.NoDirExists(t, filepath.Join(cfg.StorageFolder, "stale"), "expiry should use the access time from before the restart")
+
+	data, err = os.ReadFile(filepath.Join(cfg.StorageFolder, indexFile))
+	require.NoError(t, err)
+	index = cacheIndex{}
+	require.NoError(t, json.Unmarshal(data, &index))
+	require.Len(t, index.Repos, 1)
+	assert.Equal(t, "kept", index.Repos[0].Hash)
+}
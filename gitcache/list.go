@@ -0,0 +1,76 @@
+package gitcache
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var ErrInvalidCursor = fmt.Errorf("invalid cursor")
+
+// ListOptions selects the items of a directory listing. MaxDepth limits
+// recursive listings, 1 being the directory's own items. Glob is matched
+// against the item's path relative to the directory, or against its name
+// when the pattern has no slash. Type is "blob", "dir" or "commit", and After
+// the cursor of the last item of the previous page. OmitSizes leaves sizes
+// out, which spares object-store listings downloading every file listed.
+type ListOptions struct {
+	Recursive bool
+	MaxDepth  int
+	Glob      string
+	Type      string
+	After     string
+	OmitSizes bool
+}
+
+func (o ListOptions) matches(item GitItem, relPath string) bool {
+	if o.Type != "" && item.Type != o.Type {
+		return false
+	}
+
+	if o.MaxDepth > 0 && strings.Count(relPath, "/")+1 > o.MaxDepth {
+		return false
+	}
+
+	if o.Glob != "" {
+		name := relPath
+		if !strings.Contains(o.Glob, "/") {
+			name = path.Base(relPath)
+		}
+		if ok, _ := path.Match(o.Glob, name); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Cursor returns the position of the item in its listing, for ListOptions.After.
+func (i GitItem) Cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(i.sortKey()))
+}
+
+// sortKey orders items like a recursive ls-tree lists them. Git sorts tree
+// entries as if directory names ended with a slash, and lists a directory
+// right before its contents, so comparing the keys as strings gives the same
+// order, even across listings of different commits.
+func (i GitItem) sortKey() string {
+	if i.Type == "dir" {
+		return i.Path + "/"
+	}
+	return i.Path
+}
+
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(key) == 0 {
+		return "", ErrInvalidCursor
+	}
+
+	return string(key), nil
+}
@@ -0,0 +1,71 @@
+package gitcache
+
+import (
+	"context"
+	"io/fs"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkDir(t *testing.T) {
+	remote := newTestRemote(t)
+	for _, file := range []string{"a-b.txt", "a.txt", "a/x.md", "a/sub/y.md", "a/sub/deeper/z.md", "b.md"} {
+		remote.commit(file, file)
+	}
+
+	caches := map[string]*GitCache{
+		"worktree":     newTestDefaultCache(t),
+		"object-store": newTestObjectStoreCache(t),
+	}
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			walk := func(dir string, opts ListOptions) []string {
+				var paths []string
+				err := cache.WalkDir(context.Background(), "walk-repo", remote.url, "main", dir, opts, func(item GitItem) error {
+					paths = append(paths, item.Path)
+					return nil
+				})
+				require.NoError(t, err)
+				return paths
+			}
+
+			assert.Equal(t, []string{"a-b.txt", "a.txt", "a", "b.md"}, walk("/", ListOptions{}))
+
+			all := walk("/", ListOptions{Recursive: true})
+			assert.Equal(t, []string{"a-b.txt", "a.txt", "a", "a/sub", "a/sub/deeper", "a/sub/deeper/z.md", "a/sub/y.md", "a/x.md", "b.md"}, all)
+
+			assert.Equal(t, []string{"a/sub", "a/sub/deeper", "a/sub/y.md", "a/x.md"}, walk("/a", ListOptions{Recursive: true, MaxDepth: 2}))
+			assert.Equal(t, []string{"a/sub/deeper/z.md", "a/sub/y.md", "a/x.md", "b.md"}, walk("/", ListOptions{Recursive: true, Glob: "*.md"}))
+			assert.Equal(t, []string{"a/x.md"}, walk("/", ListOptions{Recursive: true, Glob: "a/*.md"}))
+			assert.Equal(t, []string{"a", "a/sub", "a/sub/deeper"}, walk("/", ListOptions{Recursive: true, Type: "dir"}))
+
+			// Paging one item at a time yields the whole listing.
+			var paged []string
+			var items []GitItem
+			after := ""
+			for {
+				var page []GitItem
+				err := cache.WalkDir(context.Background(), "walk-repo", remote.url, "main", "/", ListOptions{Recursive: true, After: after}, func(item GitItem) error {
+					page = append(page, item)
+					return fs.SkipAll
+				})
+				require.NoError(t, err)
+				if len(page) == 0 {
+					break
+				}
+				paged = append(paged, page[0].Path)
+				items = append(items, page[0])
+				after = page[0].Cursor()
+			}
+			assert.Equal(t, all, paged)
+			assert.True(t, sort.SliceIsSorted(items, func(i, j int) bool { return items[i].sortKey() < items[j].sortKey() }))
+
+			err := cache.WalkDir(context.Background(), "walk-repo", remote.url, "main", "/", ListOptions{After: "not a cursor!"}, func(GitItem) error { return nil })
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
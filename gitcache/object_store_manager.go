@@ -0,0 +1,659 @@
+package gitcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StorageModeWorktree    = "worktree"
+	StorageModeObjectStore = "object-store"
+)
+
+// ObjectStoreGitManager serves content straight from the repo's object store
+// without checking anything out. Stores are partial clones (blob:none), so a
+// blob is only fetched the first time it is read, and reads go through one
+// long-lived `git cat-file --batch-command` process per repo and credentials.
+type ObjectStoreGitManager struct {
+	mu        sync.Mutex
+	processes map[string]map[string]*catFileProcess
+}
+
+// catFileProcess is a cat-file process started with the credentials of
+// header, which it uses to fetch missing blobs. lastUsed is guarded by the
+// manager's lock.
+type catFileProcess struct {
+	mu       sync.Mutex
+	header   string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	lastUsed time.Time
+}
+
+// maxCatFilesPerStore bounds the processes kept for the credentials a store is
+// read with. The least recently used ones are stopped first.
+const maxCatFilesPerStore = 4
+
+// streamThreshold is the size above which blobs are streamed rather than read
+// through the cat-file process of the repo.
+const streamThreshold = 1 << 20
+
+var partialCloneSettings = []gitSetting{
+	{Key: "core.repositoryformatversion", Value: "1"},
+	{Key: "extensions.partialClone", Value: "origin"},
+	{Key: "remote.origin.promisor", Value: "true"},
+	{Key: "remote.origin.partialclonefilter", Value: "blob:none"},
+}
+
+func NewObjectStoreGitManager() *ObjectStoreGitManager {
+	return &ObjectStoreGitManager{
+		processes: make(map[string]map[string]*catFileProcess),
+	}
+}
+
+func NewGitCacheManager(storageMode string) (GitCacheManager, error) {
+	switch storageMode {
+	case StorageModeWorktree, "":
+		return &DefaultGitManager{}, nil
+	case StorageModeObjectStore:
+		return NewObjectStoreGitManager(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage mode: %s", storageMode)
+	}
+}
+
+// openFile reads small blobs through the repo's cat-file process, and streams
+// larger ones by object ID, so that they are never held in memory whole.
+func (m *ObjectStoreGitManager) openFile(b *gitBranch, filePath string) (io.ReadSeekCloser, int64, error) {
+	b.repo.rmu.RLock()
+	defer b.repo.rmu.RUnlock()
+
+	objectPath, ok := cleanObjectPath(filePath)
+	if !ok || objectPath == "" {
+		return nil, 0, ErrFileNotFound
+	}
+
+	var id string
+	var size int64
+	objectType, content, err := m.catFile(b.repo, func(p *catFileProcess) (string, []byte, error) {
+		var objectType string
+		var err error
+		id, objectType, size, err = p.info(localRef(b) + ":" + objectPath)
+		if err != nil || objectType != "blob" || size > streamThreshold {
+			return objectType, nil, err
+		}
+		return p.contents(id)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if objectType != "blob" {
+		return nil, 0, ErrFileNotFound
+	}
+
+	if size > streamThreshold {
+		return newObjectReader(b.repo, id, size), size, nil
+	}
+
+	return newMemoryFile(content), size, nil
+}
+
+func (m *ObjectStoreGitManager) resolveRef(b *gitBranch) (refKind, error) {
+	if m.containsBranch(b) {
+		return localRefKind(b.repo.storePath(), b.name)
+	}
+
+	return resolveRemoteRef(b)
+}
+
+func (m *ObjectStoreGitManager) cloneBranch(b *gitBranch) error {
+	remote := b.repo.remote()
+	if err := ensureStore(b.repo, remote, partialCloneSettings...); err != nil {
+		return err
+	}
+
+	return fetchRef(b.repo.cache.ctx, b, remote, "--filter=blob:none")
+}
+
+func (m *ObjectStoreGitManager) headSHA(b *gitBranch) (string, error) {
+	return storeHeadSHA(b)
+}
+
+func (m *ObjectStoreGitManager) blobIDs(b *gitBranch, commit, dir string) (map[string]string, error) {
+	return storeBlobIDs(b, commit, dir)
+}
+
+func (m *ObjectStoreGitManager) objectID(b *gitBranch, commit, objectPath string) (string, string, error) {
+	return storeObjectID(b, commit, objectPath)
+}
+
+func (m *ObjectStoreGitManager) lastModified(b *gitBranch, commit, objectPath string) (time.Time, error) {
+	return storeLastModified(b, commit, objectPath)
+}
+
+func (m *ObjectStoreGitManager) log(b *gitBranch, commit, logPath string, opts LogOptions) ([]Commit, error) {
+	return storeLog(b, commit, logPath, opts)
+}
+
+func (m *ObjectStoreGitManager) historyExtent(b *gitBranch, commit string) (historyExtent, error) {
+	return storeHistoryExtent(b, commit)
+}
+
+func (m *ObjectStoreGitManager) deepen(ctx context.Context, b *gitBranch, commits int) error {
+	return deepenRef(ctx, b, b.repo.remote(), commits, "--filter=blob:none")
+}
+
+func (m *ObjectStoreGitManager) mergeBase(b *gitBranch, base, head string) (string, bool, error) {
+	return storeMergeBase(b, base, head)
+}
+
+// diff fetches the blobs that differ first, since rename detection and
+// patches read them.
+func (m *ObjectStoreGitManager) diff(b *gitBranch, base, head string, patch bool) ([]FileChange, error) {
+	output, err := exec.CommandContext(b.repo.cache.ctx, "git", "-C", b.repo.storePath(), "diff-tree", "-r", "-z", "--no-renames", base, head).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare commits: %w", err)
+	}
+
+	entries, _, err := parseRawDiff(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, entry := range entries {
+		changed = append(changed, entry.blobs()...)
+	}
+
+	if err := m.fetchMissingBlobs(b, changed, base, head); err != nil {
+		return nil, err
+	}
+
+	return storeDiff(b, base, head, patch)
+}
+
+func (m *ObjectStoreGitManager) remoteHeads(ctx context.Context, r *gitRepo, branches []string) (map[string]string, error) {
+	return lsRemoteHeads(ctx, r, branches)
+}
+
+func (m *ObjectStoreGitManager) updateBranch(ctx context.Context, b *gitBranch) error {
+	return fetchRef(ctx, b, b.repo.remote(), "--filter=blob:none")
+}
+
+// resetBranch has nothing to do, since reads go to the fetched ref itself.
+func (m *ObjectStoreGitManager) resetBranch(ctx context.Context, b *gitBranch) error {
+	return nil
+}
+
+func (m *ObjectStoreGitManager) deleteBranch(b *gitBranch) error {
+	output, err := exec.Command("git", "-C", b.repo.storePath(), "update-ref", "-d", localRef(b)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to delete branch: %w, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+func (m *ObjectStoreGitManager) deleteRepo(r *gitRepo) error {
+	refs, err := listCachedRefs(r.storePath())
+	if err != nil {
+		return fmt.Errorf("failed to read repo refs: %w", err)
+	}
+
+	if len(refs) == 0 {
+		m.stopCatFile(r.storePath())
+
+		err = os.RemoveAll(r.path)
+		if err != nil {
+			return fmt.Errorf("failed to delete repo: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *ObjectStoreGitManager) containsBranch(b *gitBranch) bool {
+	if _, err := os.Stat(b.repo.storePath()); err != nil {
+		return false
+	}
+
+	_, err := localRefKind(b.repo.storePath(), b.name)
+	return err == nil
+}
+
+func (m *ObjectStoreGitManager) getCachedRepoBranches(storageFolder string) ([]repoBranchInfo, error) {
+	list := []repoBranchInfo{}
+	err := forEachStore(storageFolder, func(hash, repoPath, storePath, gitUrl string, credentials bool) error {
+		refs, err := listCachedRefs(storePath)
+		if err != nil {
+			return fmt.Errorf("failed to read refs of repo %s: %w", hash, err)
+		}
+
+		for name, kind := range refs {
+			list = append(list, repoBranchInfo{hash, name, gitUrl, kind, credentials})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// listTree downloads the blobs listed to report their sizes, so it only does
+// so when asked to. The partial clone otherwise fetches blobs as they are
+// read. The tree is listed by ID, so that the listing goes on reading the
+// same tree if the ref moves.
+func (m *ObjectStoreGitManager) listTree(b *gitBranch, dirPath string, recursive, sizes bool) (io.ReadCloser, error) {
+	b.repo.rmu.RLock()
+	defer b.repo.rmu.RUnlock()
+
+	objectPath, ok := cleanObjectPath(dirPath)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+
+	rev := localRef(b) + ":" + objectPath
+	var id string
+	objectType, _, err := m.catFile(b.repo, func(p *catFileProcess) (string, []byte, error) {
+		var objectType string
+		var err error
+		id, objectType, _, err = p.info(rev)
+		return objectType, nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if objectType != "tree" {
+		return nil, ErrFileNotFound
+	}
+
+	cmd := exec.CommandContext(b.repo.cache.ctx, "git", "-C", b.repo.storePath(), "ls-tree", id)
+	if sizes {
+		if err := m.prefetchBlobs(b, rev, recursive); err != nil {
+			return nil, err
+		}
+		cmd.Args = append(cmd.Args, "-l")
+	}
+	if recursive {
+		cmd.Args = append(cmd.Args, "-r", "-t")
+	}
+
+	return startTreeListing(cmd)
+}
+
+// prefetchBlobs downloads the missing blobs of a directory, or of the whole
+// subtree when recursive, in one fetch. Listing sizes would otherwise make git
+// fetch them one at a time.
+func (m *ObjectStoreGitManager) prefetchBlobs(b *gitBranch, rev string, recursive bool) error {
+	storePath := b.repo.storePath()
+	list := exec.CommandContext(b.repo.cache.ctx, "git", "-C", storePath, "ls-tree", rev)
+	if recursive {
+		list.Args = append(list.Args, "-r")
+	}
+	entries, err := list.Output()
+	if err != nil {
+		return fmt.Errorf("failed to list tree: %w", err)
+	}
+
+	var blobs []string
+	for _, line := range strings.Split(string(entries), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == "blob" {
+			blobs = append(blobs, fields[2])
+		}
+	}
+
+	return m.fetchMissingBlobs(b, blobs, rev)
+}
+
+// fetchMissingBlobs downloads those of blobs, all found in the trees of revs,
+// that the store doesn't have yet.
+func (m *ObjectStoreGitManager) fetchMissingBlobs(b *gitBranch, blobs []string, revs ...string) error {
+	storePath := b.repo.storePath()
+	args := append([]string{"-C", storePath, "rev-list", "--objects", "--no-walk", "--missing=print"}, revs...)
+	missing, err := exec.CommandContext(b.repo.cache.ctx, "git", args...).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list missing objects: %w", err)
+	}
+
+	missingBlobs := make(map[string]bool)
+	for _, line := range strings.Split(string(missing), "\n") {
+		if strings.HasPrefix(line, "?") {
+			missingBlobs[line[1:]] = true
+		}
+	}
+
+	var wanted []string
+	for _, id := range blobs {
+		if missingBlobs[id] {
+			wanted = append(wanted, id)
+			delete(missingBlobs, id)
+		}
+	}
+
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	remote := b.repo.remote()
+	cmd := remote.command(b.repo.cache.ctx, "-C", storePath, "-c", "fetch.negotiationAlgorithm=noop",
+		"fetch", "--no-tags", "--no-write-fetch-head", "--recurse-submodules=no", "--filter=blob:none", "--stdin", "origin")
+	cmd.Stdin = strings.NewReader(strings.Join(wanted, "\n") + "\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to fetch blobs: %w, output: %s", err, remote.redact(output))
+	}
+
+	return nil
+}
+
+// catFile runs fn against the repo's cat-file process for the credentials
+// of its remote, starting it when needed. A process that fails is discarded
+// so the next call starts afresh. Processes are stopped outside of the
+// manager's lock, since stopping one waits for the read it is serving.
+func (m *ObjectStoreGitManager) catFile(r *gitRepo, fn func(p *catFileProcess) (string, []byte, error)) (string, []byte, error) {
+	remote := r.remote()
+	storePath := r.storePath()
+
+	m.mu.Lock()
+	processes := m.processes[storePath]
+	p, ok := processes[remote.header]
+	var retired []*catFileProcess
+	if !ok {
+		var err error
+		p, err = startCatFile(r, remote)
+		if err != nil {
+			m.mu.Unlock()
+			return "", nil, err
+		}
+		if processes == nil {
+			processes = make(map[string]*catFileProcess)
+			m.processes[storePath] = processes
+		}
+		processes[remote.header] = p
+	}
+	p.lastUsed = time.Now()
+	if !ok {
+		retired = retireCatFiles(processes)
+	}
+	m.mu.Unlock()
+
+	for _, old := range retired {
+		go old.close()
+	}
+
+	objectType, content, err := fn(p)
+	if err != nil && err != ErrFileNotFound {
+		m.mu.Lock()
+		if m.processes[storePath][p.header] == p {
+			delete(m.processes[storePath], p.header)
+		}
+		m.mu.Unlock()
+		p.close()
+	}
+
+	return objectType, content, err
+}
+
+// retireCatFiles removes the least recently used processes of a store beyond
+// maxCatFilesPerStore, and returns them to be stopped. The caller holds the
+// manager's lock.
+func retireCatFiles(processes map[string]*catFileProcess) []*catFileProcess {
+	var retired []*catFileProcess
+	for len(processes) > maxCatFilesPerStore {
+		var oldest *catFileProcess
+		for _, p := range processes {
+			if oldest == nil || p.lastUsed.Before(oldest.lastUsed) {
+				oldest = p
+			}
+		}
+		delete(processes, oldest.header)
+		retired = append(retired, oldest)
+	}
+	return retired
+}
+
+func (m *ObjectStoreGitManager) stopCatFile(storePath string) {
+	m.mu.Lock()
+	processes := m.processes[storePath]
+	delete(m.processes, storePath)
+	m.mu.Unlock()
+
+	for _, p := range processes {
+		p.close()
+	}
+}
+
+func startCatFile(r *gitRepo, remote *gitRemote) (*catFileProcess, error) {
+	cmd := remote.command(r.cache.ctx, "-C", r.storePath(), "cat-file", "--batch-command")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cat-file input: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cat-file output: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start cat-file: %w", err)
+	}
+
+	return &catFileProcess{
+		header: remote.header,
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// info returns the ID, type and size of the object at rev.
+func (p *catFileProcess) info(rev string) (string, string, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.request("info", rev)
+}
+
+func (p *catFileProcess) contents(rev string) (string, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, objectType, size, err := p.request("contents", rev)
+	if err != nil {
+		return "", nil, err
+	}
+
+	content := make([]byte, size+1)
+	if _, err := io.ReadFull(p.stdout, content); err != nil {
+		return "", nil, fmt.Errorf("failed to read object: %w", err)
+	}
+
+	return objectType, content[:size], nil
+}
+
+// request sends a command for rev and returns the ID, type and size of the
+// object from the header of the reply.
+func (p *catFileProcess) request(command, rev string) (string, string, int64, error) {
+	if _, err := fmt.Fprintf(p.stdin, "%s %s\n", command, rev); err != nil {
+		return "", "", 0, fmt.Errorf("failed to query object: %w", err)
+	}
+
+	line, err := p.stdout.ReadString('\n')
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to read object header: %w", err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 3 {
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("invalid object header: %s", line)
+		}
+		return fields[0], fields[1], size, nil
+	}
+
+	if strings.HasSuffix(line, " missing\n") {
+		return "", "", 0, ErrFileNotFound
+	}
+
+	return "", "", 0, fmt.Errorf("unexpected object header: %s", strings.TrimSpace(line))
+}
+
+func (p *catFileProcess) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_ = p.stdin.Close()
+	_ = p.cmd.Wait()
+}
+
+// objectReader streams a blob from a `git cat-file blob` process of its own.
+// A seek to another offset stops the process, and the next read starts a new
+// one that skips to the offset.
+type objectReader struct {
+	repo   *gitRepo
+	id     string
+	size   int64
+	offset int64
+
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+}
+
+func newObjectReader(r *gitRepo, id string, size int64) *objectReader {
+	return &objectReader{repo: r, id: id, size: size}
+}
+
+func (o *objectReader) Read(buf []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.cmd == nil {
+		if err := o.start(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := o.stdout.Read(buf[:min(int64(len(buf)), o.size-o.offset)])
+	o.offset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (o *objectReader) start() error {
+	cmd := o.repo.remote().command(o.repo.cache.ctx, "-C", o.repo.storePath(), "cat-file", "blob", o.id)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open blob output: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start cat-file: %w", err)
+	}
+	o.cmd = cmd
+	o.stdout = stdout
+
+	if _, err := io.CopyN(io.Discard, stdout, o.offset); err != nil {
+		o.stop()
+		return fmt.Errorf("failed to seek blob: %w", err)
+	}
+
+	return nil
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d", offset)
+	}
+
+	if offset != o.offset {
+		o.stop()
+		o.offset = offset
+	}
+
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	o.stop()
+	return nil
+}
+
+func (o *objectReader) stop() {
+	if o.cmd == nil {
+		return
+	}
+
+	_ = o.cmd.Process.Kill()
+	_ = o.cmd.Wait()
+	o.cmd = nil
+	o.stdout = nil
+}
+
+// cleanObjectPath turns a request path into a path inside a git tree. Paths
+// that can't be expressed on a cat-file command line are rejected.
+func cleanObjectPath(p string) (string, bool) {
+	if strings.ContainsAny(p, "\n\x00") {
+		return "", false
+	}
+	return strings.TrimPrefix(path.Clean("/"+p), "/"), true
+}
+
+// listCachedRefs returns every ref cached in a store with its kind.
+func listCachedRefs(storePath string) (map[string]refKind, error) {
+	output, err := exec.Command("git", "-C", storePath, "for-each-ref", "--format=%(refname)",
+		"refs/heads", "refs/tags", "refs/commits").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %w", err)
+	}
+
+	refs := make(map[string]refKind)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		ref := scanner.Text()
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			refs[strings.TrimPrefix(ref, "refs/heads/")] = refBranch
+		case strings.HasPrefix(ref, "refs/tags/"):
+			name := strings.TrimPrefix(ref, "refs/tags/")
+			if _, ok := refs[name]; !ok {
+				refs[name] = refTag
+			}
+		case strings.HasPrefix(ref, "refs/commits/"):
+			name := strings.TrimPrefix(ref, "refs/commits/")
+			if _, ok := refs[name]; !ok {
+				refs[name] = refCommit
+			}
+		}
+	}
+
+	return refs, nil
+}
@@ -0,0 +1,196 @@
+package gitcache
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestObjectStoreCache(t *testing.T) *GitCache {
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           time.Hour,
+		RepoCheckInterval: time.Minute,
+	}
+	return NewGitCache(cfg, context.Background(), NewObjectStoreGitManager())
+}
+
+func missingObjects(t *testing.T, remote *testRemote, storePath string) int {
+	output := remote.git("-C", storePath, "rev-list", "--objects", "--missing=print", "--all")
+	return strings.Count(output, "?")
+}
+
+func TestObjectStoreGitManager(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commit("README.md", "readme")
+	remote.commit("docs/a.txt", "a")
+	remote.commit("docs/b.txt", "bb")
+	remote.git("tag", "v1")
+
+	cache := newTestObjectStoreCache(t)
+	hash := "object-store-repo"
+	repoPath := filepath.Join(cache.cfg.StorageFolder, hash)
+	storePath := filepath.Join(repoPath, storeDir)
+
+	content, err := cache.GetFileBlob(context.Background(), hash, remote.url, "main", "/README.md")
+	require.NoError(t, err)
+	assert.Equal(t, "readme", string(content))
+
+	entries, err := os.ReadDir(repoPath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no worktree should be checked out")
+	assert.Equal(t, 2, missingObjects(t, remote, storePath), "unread blobs should not be fetched")
+
+	_, err = cache.GetFileBlob(context.Background(), hash, remote.url, "main", "docs")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	_, err = cache.GetFileBlob(context.Background(), hash, remote.url, "main", "missing.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	// Listings that leave sizes out don't download the files listed.
+	var items []GitItem
+	err = cache.WalkDir(context.Background(), hash, remote.url, "main", "/docs", ListOptions{OmitSizes: true}, func(item GitItem) error {
+		items = append(items, item)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "docs/a.txt", items[0].Path)
+	assert.Nil(t, items[0].Size)
+	assert.Equal(t, 2, missingObjects(t, remote, storePath))
+
+	items, err = cache.ListDir(context.Background(), hash, remote.url, "main", "/docs")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.NotNil(t, items[0].Size)
+	assert.Equal(t, int64(1), *items[0].Size)
+	assert.Equal(t, int64(2), *items[1].Size)
+	assert.Equal(t, 0, missingObjects(t, remote, storePath))
+
+	_, err = cache.ListDir(context.Background(), hash, remote.url, "main", "/README.md")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	content, err = cache.GetFileBlob(context.Background(), hash, remote.url, "v1", "docs/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "bb", string(content))
+
+	remote.commit("README.md", "pushed")
+	require.NoError(t, cache.checkRepos())
+
+	content, err = cache.GetFileBlob(context.Background(), hash, remote.url, "main", "README.md")
+	require.NoError(t, err)
+	assert.Equal(t, "pushed", string(content))
+
+	infos, err := cache.manager.getCachedRepoBranches(cache.cfg.StorageFolder)
+	require.NoError(t, err)
+	kinds := map[string]refKind{}
+	for _, info := range infos {
+		kinds[info.branch] = info.kind
+	}
+	assert.Equal(t, map[string]refKind{"main": refBranch, "v1": refTag}, kinds)
+
+	for _, ref := range []string{"main", "v1"} {
+		b, err := cache.getBranch(hash, remote.url, ref)
+		require.NoError(t, err)
+		require.NoError(t, b.delete())
+	}
+
+	_, err = os.Stat(repoPath)
+	assert.True(t, os.IsNotExist(err), "repo should be removed with its last ref")
+}
+
+func TestObjectStoreStreamsLargeBlobs(t *testing.T) {
+	content := make([]byte, 3*streamThreshold)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	remote := newTestRemote(t)
+	remote.commit("large.bin", string(content))
+
+	cache := newTestObjectStoreCache(t)
+	hash := "stream-repo"
+
+	f, err := cache.OpenFile(context.Background(), hash, remote.url, "main", "large.bin")
+	require.NoError(t, err)
+	require.IsType(t, &objectReader{}, f.(*branchFile).ReadSeekCloser, "large blobs should be streamed")
+
+	read, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, content, read)
+
+	size, err := f.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+
+	offset := int64(streamThreshold + 17)
+	_, err = f.Seek(offset, io.SeekStart)
+	require.NoError(t, err)
+	part := make([]byte, 100)
+	_, err = io.ReadFull(f, part)
+	require.NoError(t, err)
+	assert.Equal(t, content[offset:offset+100], part)
+
+	b, err := cache.getBranch(hash, remote.url, "main")
+	require.NoError(t, err)
+	assert.ErrorIs(t, b.delete(), errBranchInUse, "an open file should keep its branch")
+
+	require.NoError(t, f.Close())
+	require.NoError(t, f.Close())
+	require.NoError(t, b.delete())
+}
+
+func TestObjectStoreCatFilePerCredentials(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commit("file.txt", "shared")
+
+	cache := newTestObjectStoreCache(t)
+	manager := cache.manager.(*ObjectStoreGitManager)
+	hash := "credentials-repo"
+
+	read := func(gitUrl string) {
+		content, err := cache.GetFileBlob(context.Background(), hash, gitUrl, "main", "file.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "shared", string(content))
+	}
+
+	r, err := cache.getRepo(hash, remote.url)
+	require.NoError(t, err)
+	processes := func() map[string]*catFileProcess {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		copied := make(map[string]*catFileProcess)
+		for header, p := range manager.processes[r.storePath()] {
+			copied[header] = p
+		}
+		return copied
+	}
+
+	read(remote.url)
+	first := processes()
+	require.Len(t, first, 1)
+
+	// Readers with other credentials get a process of their own, rather than
+	// restart the one in use.
+	alice := "file://alice:secret@" + remote.path
+	read(alice)
+	both := processes()
+	require.Len(t, both, 2)
+	assert.Same(t, first[""], both[""])
+
+	for i := 0; i < maxCatFilesPerStore+2; i++ {
+		read(fmt.Sprintf("file://user%d:secret@%s", i, remote.path))
+	}
+	assert.Len(t, processes(), maxCatFilesPerStore, "the least recently used processes should be stopped")
+
+	manager.stopCatFile(r.storePath())
+	assert.Empty(t, processes())
+}
@@ -0,0 +1,147 @@
+package gitcache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"github.com/costinul/git-rest-cache/logger"
+)
+
+// storageLowWater is the share of max-storage-bytes that eviction brings the
+// storage down to, so that a full cache doesn't evict on every clone.
+const storageLowWater = 0.9
+
+// measure records the disk usage of the branch checkout and of the store of
+// its repo.
+func (b *gitBranch) measure() {
+	size := dirSize(b.path)
+	storeSize := dirSize(b.repo.storePath())
+
+	b.repo.rmu.Lock()
+	defer b.repo.rmu.Unlock()
+
+	b.size = size
+	b.repo.storeSize = storeSize
+	b.measured = true
+}
+
+func dirSize(root string) int64 {
+	var size int64
+	_ = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// storageUsage returns the bytes used by the cached repos, along with their
+// branches. Branches rediscovered on disk are measured the first time.
+func (c *GitCache) storageUsage() (int64, []*gitBranch) {
+	c.cmu.RLock()
+	repos := make([]*gitRepo, 0, len(c.repos))
+	for _, r := range c.repos {
+		repos = append(repos, r)
+	}
+	c.cmu.RUnlock()
+
+	var usage int64
+	var branches []*gitBranch
+	for _, r := range repos {
+		var unmeasured []*gitBranch
+		r.rmu.RLock()
+		for _, b := range r.branches {
+			if !b.measured {
+				unmeasured = append(unmeasured, b)
+			}
+		}
+		r.rmu.RUnlock()
+
+		for _, b := range unmeasured {
+			b.measure()
+		}
+
+		r.rmu.RLock()
+		for _, b := range r.branches {
+			usage += b.size
+			branches = append(branches, b)
+		}
+		usage += r.storeSize
+		r.rmu.RUnlock()
+	}
+
+	return usage, branches
+}
+
+// enforceQuota evicts the least recently accessed branches once the storage
+// exceeds max-storage-bytes, until it is back under the low-water mark.
+// Branches that are being read are never evicted.
+func (c *GitCache) enforceQuota() {
+	if c.cfg.MaxStorageBytes <= 0 {
+		return
+	}
+
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+
+	usage, branches := c.storageUsage()
+	if usage <= c.cfg.MaxStorageBytes {
+		return
+	}
+
+	target := int64(float64(c.cfg.MaxStorageBytes) * storageLowWater)
+
+	type candidate struct {
+		branch   *gitBranch
+		accessed int64
+	}
+	candidates := make([]candidate, 0, len(branches))
+	for _, b := range branches {
+		b.repo.rmu.RLock()
+		candidates = append(candidates, candidate{branch: b, accessed: b.lastAccessed.UnixNano()})
+		b.repo.rmu.RUnlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accessed < candidates[j].accessed
+	})
+
+	for _, candidate := range candidates {
+		if usage <= target {
+			break
+		}
+
+		b := candidate.branch
+		b.repo.rmu.RLock()
+		size := b.size
+		b.repo.rmu.RUnlock()
+
+		if err := b.delete(); err != nil {
+			if !errors.Is(err, errBranchInUse) {
+				logger.Error(fmt.Sprintf("failed to evict %s/%s: %v", b.repo.hash, b.name, err))
+			}
+			continue
+		}
+		usage -= size
+
+		b.repo.rmu.RLock()
+		if len(b.repo.branches) == 0 {
+			usage -= b.repo.storeSize
+		}
+		b.repo.rmu.RUnlock()
+
+		logger.Info(fmt.Sprintf("evicted %s/%s to free storage (%d bytes used of %d)", b.repo.hash, b.name, usage, c.cfg.MaxStorageBytes))
+	}
+
+	if usage > c.cfg.MaxStorageBytes {
+		logger.Warn(fmt.Sprintf("storage (%d bytes) exceeds max-storage-bytes (%d) after eviction", usage, c.cfg.MaxStorageBytes))
+	}
+}
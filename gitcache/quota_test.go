@@ -0,0 +1,65 @@
+package gitcache
+
+import (
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnforceQuotaEvictsLeastRecentlyRead(t *testing.T) {
+	cfg := &config.Config{
+		StorageFolder:     t.TempDir(),
+		RepoTTL:           time.Hour,
+		RepoCheckInterval: time.Minute,
+	}
+	cache := NewGitCache(cfg, context.Background(), &DefaultGitManager{})
+
+	hashes := []string{"oldest", "older", "recent"}
+	remotes := map[string]*testRemote{}
+	for _, hash := range hashes {
+		content := make([]byte, 256<<10)
+		_, err := rand.Read(content)
+		require.NoError(t, err)
+
+		remotes[hash] = newTestRemote(t)
+		remotes[hash].commit("file.bin", string(content))
+		_, err = cache.GetFileBlob(context.Background(), hash, remotes[hash].url, "main", "file.bin")
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	usage, branches := cache.storageUsage()
+	require.Len(t, branches, 3)
+	assert.Greater(t, usage, int64(3*256<<10))
+
+	cfg.MaxStorageBytes = usage + 1
+	cache.enforceQuota()
+	assert.DirExists(t, cache.repos["oldest"].path, "nothing is evicted within the budget")
+
+	// A branch being read is skipped, so the next one in line is evicted.
+	reading, err := cache.acquireBranch("oldest", remotes["oldest"].url, "main")
+	require.NoError(t, err)
+
+	cfg.MaxStorageBytes = usage * 3 / 4
+	cache.enforceQuota()
+
+	assert.DirExists(t, reading.path)
+	assert.NoDirExists(t, filepath.Join(cfg.StorageFolder, "older"), "the least recently read idle branch should be evicted")
+	assert.DirExists(t, filepath.Join(cfg.StorageFolder, "recent"))
+
+	after, _ := cache.storageUsage()
+	assert.LessOrEqual(t, after, int64(float64(cfg.MaxStorageBytes)*storageLowWater))
+
+	reading.release()
+	cfg.MaxStorageBytes = 0
+
+	content, err := cache.GetFileBlob(context.Background(), "older", remotes["older"].url, "main", "file.bin")
+	require.NoError(t, err, "evicted branches are cloned again on demand")
+	assert.Len(t, content, 256<<10)
+}
@@ -0,0 +1,96 @@
+package gitcache
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/costinul/git-rest-cache/logger"
+)
+
+// RefreshBranch schedules an update of the branch in every cached repo that
+// was cloned from one of remoteURLs, whichever token or protocol it was
+// cloned with, and returns the number of branches scheduled. Updates wait for
+// the webhook debounce period, which restarts with every further push to the
+// branch, so a burst of pushes costs a single fetch.
+func (c *GitCache) RefreshBranch(remoteURLs []string, branch string) int {
+	remotes := make(map[string]bool)
+	for _, remoteURL := range remoteURLs {
+		if remote := normalizeRemote(remoteURL); remote != "" {
+			remotes[remote] = true
+		}
+	}
+
+	c.cmu.RLock()
+	var repos []*gitRepo
+	for _, r := range c.repos {
+		repos = append(repos, r)
+	}
+	c.cmu.RUnlock()
+
+	scheduled := 0
+	for _, r := range repos {
+		r.rmu.RLock()
+		b, ok := r.branches[branch]
+		matches := ok && remotes[normalizeRemote(r.url())] && b.kind == refBranch
+		r.rmu.RUnlock()
+
+		if matches {
+			c.scheduleUpdate(b)
+			scheduled++
+		}
+	}
+
+	return scheduled
+}
+
+func (c *GitCache) scheduleUpdate(b *gitBranch) {
+	c.rfmu.Lock()
+	defer c.rfmu.Unlock()
+
+	if timer, ok := c.refreshes[b]; ok {
+		timer.Reset(c.cfg.WebhookDebounce)
+		return
+	}
+
+	c.refreshes[b] = time.AfterFunc(c.cfg.WebhookDebounce, func() {
+		c.rfmu.Lock()
+		delete(c.refreshes, b)
+		c.rfmu.Unlock()
+
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		if requiresCredentials(b.repo.storePath()) && !b.repo.hasCredentials() {
+			logger.Debug(fmt.Sprintf("skipping update of %s/%s until a request provides credentials", b.repo.hash, b.name))
+			return
+		}
+
+		ctx, cancel := c.updateContext()
+		defer cancel()
+
+		if err := b.update(ctx); err != nil {
+			logger.Error(fmt.Sprintf("failed to update %s/%s after push: %v", b.repo.hash, b.name, err))
+		}
+	})
+}
+
+// normalizeRemote reduces a git URL to its lower-cased host and repo path, so
+// that the HTTPS and SSH remotes of a repo, with or without credentials or a
+// .git suffix, compare equal.
+func normalizeRemote(gitUrl string) string {
+	host, repoPath, ok := parseSSHURL(gitUrl)
+	if !ok {
+		u, err := url.Parse(gitUrl)
+		if err != nil || u.Host == "" {
+			return ""
+		}
+		host, repoPath = u.Hostname(), u.Path
+	}
+
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+
+	return strings.ToLower(host + "/" + repoPath)
+}
@@ -21,6 +21,25 @@ func (c *GitCache) RemoveAccess(token, repoHash string) {
 	c.tokenCache.Delete(key)
 }
 
+// SetPublic records whether the repo behind a token-independent hash can be
+// read anonymously.
+func (c *GitCache) SetPublic(repoHash string, public bool) {
+	c.tokenCache.Set(buildPublicKey(repoHash), public, c.cfg.TokenTTL)
+}
+
+func (c *GitCache) IsPublic(repoHash string) (public bool, known bool) {
+	item := c.tokenCache.Get(buildPublicKey(repoHash))
+	if item == nil || item.Expired() {
+		return false, false
+	}
+
+	return item.Value().(bool), true
+}
+
+func buildPublicKey(repoHash string) string {
+	return "public|" + repoHash
+}
+
 func buildKey(token, repoHash string) string {
 	return token + "|" + repoHash
 }
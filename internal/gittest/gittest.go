@@ -0,0 +1,61 @@
+// Package gittest serves git repos over git's smart HTTP protocol, for tests
+// that clone or query them like a real git host.
+package gittest
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// NewServer serves a bare repo at each of repoPaths through git http-backend,
+// all holding a single commit of files. Requests that authorize rejects get
+// a 401 asking for basic auth. The server is closed with the test.
+func NewServer(t testing.TB, files map[string]string, repoPaths []string, authorize func(r *http.Request) bool) *httptest.Server {
+	root := t.TempDir()
+	work := t.TempDir()
+
+	git := func(args ...string) {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		output, err := exec.Command("git", args...).CombinedOutput()
+		require.NoError(t, err, "git %v: %s", args, output)
+	}
+
+	git("-C", work, "init", "--quiet", "--initial-branch=main")
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(work, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(work, name), []byte(content), 0644))
+		git("-C", work, "add", name)
+	}
+	git("-C", work, "commit", "--quiet", "-m", "initial")
+	for _, repoPath := range repoPaths {
+		git("clone", "--quiet", "--bare", work, filepath.Join(root, filepath.FromSlash(repoPath)))
+	}
+
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	require.NoError(t, err)
+
+	backend := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize != nil && !authorize(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
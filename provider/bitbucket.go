@@ -0,0 +1,201 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/costinul/git-rest-cache/gitauth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	bitbucketCloudAPIURL   = "https://api.bitbucket.org"
+	bitbucketCloudCloneURL = "https://bitbucket.org"
+
+	// bitbucketTokenUser is the username Bitbucket Cloud expects when an
+	// access token is used for git over HTTPS.
+	bitbucketTokenUser = "x-token-auth"
+)
+
+type bitbucketCloudProvider struct {
+	apiURL   string
+	cloneURL string
+	cfg      *config.Config
+}
+
+type bitbucketCloudRepo struct {
+	provider  *bitbucketCloudProvider
+	workspace string
+	repo      string
+	token     string
+}
+
+type bitbucketServerProvider struct {
+	baseURL string
+}
+
+type bitbucketServerRepo struct {
+	provider *bitbucketServerProvider
+	project  string
+	repo     string
+	token    string
+}
+
+func newBitbucketCloudProvider(cfg *config.Config) *bitbucketCloudProvider {
+	return &bitbucketCloudProvider{
+		apiURL:   bitbucketCloudAPIURL,
+		cloneURL: bitbucketCloudCloneURL,
+		cfg:      cfg,
+	}
+}
+
+func (p *bitbucketCloudProvider) GetURLPath() string {
+	return "/bitbucket/:workspace/:repo"
+}
+
+func (p *bitbucketCloudProvider) GetRepo(c *gin.Context) (ProviderRepo, error) {
+	return &bitbucketCloudRepo{
+		provider:  p,
+		workspace: c.Param("workspace"),
+		repo:      c.Param("repo"),
+		token:     c.GetHeader("X-Token"),
+	}, nil
+}
+
+func (r *bitbucketCloudRepo) Hash() string {
+	return computeRepoHash("bitbucket", r.token, r.workspace, r.repo)
+}
+
+func (r *bitbucketCloudRepo) RepoURL() string {
+	return fmt.Sprintf("%s/%s/%s", r.provider.cloneURL, r.workspace, r.repo)
+}
+
+// ValidateToken accepts either an access token, sent as a bearer token, or an
+// app password in the form "username:app-password", sent with basic auth.
+func (r *bitbucketCloudRepo) ValidateToken(token string) (bool, error) {
+	repoURL := fmt.Sprintf("%s/2.0/repositories/%s/%s", r.provider.apiURL, url.PathEscape(r.workspace), url.PathEscape(r.repo))
+
+	req, err := http.NewRequest("GET", repoURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	setBitbucketAuth(req, token)
+
+	return checkAccess(req)
+}
+
+func (r *bitbucketCloudRepo) GitURL() string {
+	if sshURL := sshGitURL(r.provider.cfg, r.provider.cloneURL, r.workspace+"/"+r.repo); sshURL != "" {
+		return sshURL
+	}
+
+	return bitbucketGitURL(fmt.Sprintf("%s/%s/%s.git", r.provider.cloneURL, r.workspace, r.repo), r.token, bitbucketTokenUser)
+}
+
+func (r *bitbucketCloudRepo) Origin() (string, string) {
+	return "bitbucket", r.workspace + "/" + r.repo
+}
+
+func (r *bitbucketCloudRepo) Anonymous() ProviderRepo {
+	return &bitbucketCloudRepo{
+		provider:  r.provider,
+		workspace: r.workspace,
+		repo:      r.repo,
+	}
+}
+
+func newBitbucketServerProvider(baseURL string) *bitbucketServerProvider {
+	return &bitbucketServerProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (p *bitbucketServerProvider) GetURLPath() string {
+	return "/bitbucket-server/:project/:repo"
+}
+
+func (p *bitbucketServerProvider) GetRepo(c *gin.Context) (ProviderRepo, error) {
+	return &bitbucketServerRepo{
+		provider: p,
+		project:  c.Param("project"),
+		repo:     c.Param("repo"),
+		token:    c.GetHeader("X-Token"),
+	}, nil
+}
+
+func (r *bitbucketServerRepo) Hash() string {
+	return computeRepoHash("bitbucket-server|"+r.provider.baseURL, r.token, r.project, r.repo)
+}
+
+func (r *bitbucketServerRepo) RepoURL() string {
+	return fmt.Sprintf("%s/projects/%s/repos/%s", r.provider.baseURL, r.project, r.repo)
+}
+
+// ValidateToken accepts either an HTTP access token, sent as a bearer token,
+// or "username:token" credentials, sent with basic auth.
+func (r *bitbucketServerRepo) ValidateToken(token string) (bool, error) {
+	repoURL := fmt.Sprintf("%s/rest/api/1.0/projects/%s/repos/%s", r.provider.baseURL, url.PathEscape(r.project), url.PathEscape(r.repo))
+
+	req, err := http.NewRequest("GET", repoURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	setBitbucketAuth(req, token)
+
+	return checkAccess(req)
+}
+
+// GitURL sends HTTP access tokens as bearer tokens, which Bitbucket Server
+// accepts for git as it does for its API.
+func (r *bitbucketServerRepo) GitURL() string {
+	return bitbucketGitURL(fmt.Sprintf("%s/scm/%s/%s.git", r.provider.baseURL, strings.ToLower(r.project), r.repo), r.token, gitauth.BearerTokenUser)
+}
+
+func (r *bitbucketServerRepo) Origin() (string, string) {
+	return "bitbucket-server", r.project + "/" + r.repo
+}
+
+func (r *bitbucketServerRepo) Anonymous() ProviderRepo {
+	return &bitbucketServerRepo{
+		provider: r.provider,
+		project:  r.project,
+		repo:     r.repo,
+	}
+}
+
+func setBitbucketAuth(req *http.Request, token string) {
+	if token == "" {
+		return
+	}
+
+	if username, password, ok := strings.Cut(token, ":"); ok {
+		req.SetBasicAuth(username, password)
+		return
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+}
+
+// bitbucketGitURL embeds "username:password" tokens as they are, and other
+// tokens under tokenUser.
+func bitbucketGitURL(cloneURL, token, tokenUser string) string {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return ""
+	}
+
+	if token != "" {
+		if username, password, ok := strings.Cut(token, ":"); ok {
+			u.User = url.UserPassword(username, password)
+		} else {
+			u.User = url.UserPassword(tokenUser, token)
+		}
+	}
+
+	return u.String()
+}
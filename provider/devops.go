@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	devopsBaseURL = "https://dev.azure.com"
+
+	// devopsTokenUser is sent as the username with a personal access token.
+	// Azure DevOps ignores it, but git needs a non-empty one.
+	devopsTokenUser = "pat"
+)
+
+type devopsProvider struct {
+	baseURL string
+}
+
+type devopsRepo struct {
+	provider     *devopsProvider
+	organization string
+	project      string
+	repo         string
+	token        string
+}
+
+func newDevopsProvider() *devopsProvider {
+	return &devopsProvider{
+		baseURL: devopsBaseURL,
+	}
+}
+
+func (p *devopsProvider) GetURLPath() string {
+	return "/devops/:organization/:project/:repo"
+}
+
+func (p *devopsProvider) GetRepo(c *gin.Context) (ProviderRepo, error) {
+	return &devopsRepo{
+		provider:     p,
+		organization: c.Param("organization"),
+		project:      c.Param("project"),
+		repo:         c.Param("repo"),
+		token:        c.GetHeader("X-Token"),
+	}, nil
+}
+
+func (r *devopsRepo) Hash() string {
+	return computeRepoHash("devops", r.token, r.organization, r.project, r.repo)
+}
+
+func (r *devopsRepo) RepoURL() string {
+	return fmt.Sprintf("%s/%s/%s/_git/%s", r.provider.baseURL, r.organization, r.project, r.repo)
+}
+
+// ValidateToken checks a personal access token, sent with basic auth and an
+// empty username, against the Git Repositories API.
+func (r *devopsRepo) ValidateToken(token string) (bool, error) {
+	repoURL := fmt.Sprintf("%s/%s/%s/_apis/git/repositories/%s?api-version=7.0",
+		r.provider.baseURL, url.PathEscape(r.organization), url.PathEscape(r.project), url.PathEscape(r.repo))
+
+	req, err := http.NewRequest("GET", repoURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if token != "" {
+		req.SetBasicAuth("", token)
+	}
+
+	return checkAccess(req)
+}
+
+func (r *devopsRepo) GitURL() string {
+	u, err := url.Parse(r.provider.baseURL)
+	if err != nil {
+		return ""
+	}
+	u.Path += fmt.Sprintf("/%s/%s/_git/%s", r.organization, r.project, r.repo)
+
+	if r.token != "" {
+		u.User = url.UserPassword(devopsTokenUser, r.token)
+	}
+
+	return u.String()
+}
+
+func (r *devopsRepo) Origin() (string, string) {
+	return "devops", r.organization + "/" + r.project + "/" + r.repo
+}
+
+func (r *devopsRepo) Anonymous() ProviderRepo {
+	return &devopsRepo{
+		provider:     r.provider,
+		organization: r.organization,
+		project:      r.project,
+		repo:         r.repo,
+	}
+}
@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/costinul/git-rest-cache/gitauth"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	GitAuthBasic = "basic"
+	GitAuthNone  = "none"
+
+	// gitDefaultUsername is sent with tokens that don't carry their own
+	// username. Most servers that accept tokens as passwords ignore it.
+	gitDefaultUsername = "git"
+)
+
+// gitAccessDeniedRegex matches the git errors of a remote that refused the
+// credentials, or hides the repo from them behind a 404, which git reports as
+// "repository '<url>' not found".
+var gitAccessDeniedRegex = regexp.MustCompile(`(?i)authentication failed|terminal prompts disabled|could not read (username|password)|repository '[^']*' not found|returned error: 40[134]`)
+
+type gitHostProvider struct {
+	name     string
+	baseURL  string
+	auth     string
+	username string
+}
+
+type gitHostRepo struct {
+	provider *gitHostProvider
+	path     string
+	token    string
+}
+
+func newGitHostProvider(host config.GitHost) (*gitHostProvider, error) {
+	if host.Name == "" || strings.Contains(host.Name, "/") {
+		return nil, fmt.Errorf("invalid git host name: %q", host.Name)
+	}
+
+	u, err := url.Parse(host.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, fmt.Errorf("invalid url for git host %s: %q", host.Name, host.URL)
+	}
+
+	auth := host.Auth
+	if auth == "" {
+		auth = GitAuthBasic
+	}
+	if auth != GitAuthBasic && auth != GitAuthNone {
+		return nil, fmt.Errorf("invalid auth for git host %s: %q", host.Name, host.Auth)
+	}
+
+	username := host.Username
+	if username == "" {
+		username = gitDefaultUsername
+	}
+
+	return &gitHostProvider{
+		name:     host.Name,
+		baseURL:  strings.TrimSuffix(host.URL, "/"),
+		auth:     auth,
+		username: username,
+	}, nil
+}
+
+func (p *gitHostProvider) GetURLPath() string {
+	return "/git/" + p.name
+}
+
+func (p *gitHostProvider) IsNested() bool {
+	return true
+}
+
+func (p *gitHostProvider) GetRepo(c *gin.Context) (ProviderRepo, error) {
+	repoPath := strings.Trim(c.Param(RepoPathParam), "/")
+	for _, segment := range strings.Split(repoPath, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid git repo path: %s", repoPath)
+		}
+	}
+
+	repo := &gitHostRepo{
+		provider: p,
+		path:     repoPath,
+	}
+	if p.auth == GitAuthBasic {
+		repo.token = c.GetHeader("X-Token")
+	}
+
+	return repo, nil
+}
+
+func (r *gitHostRepo) Hash() string {
+	return computeRepoHash("git|"+r.provider.baseURL, r.token, r.path)
+}
+
+func (r *gitHostRepo) RepoURL() string {
+	return fmt.Sprintf("%s/%s", r.provider.baseURL, r.path)
+}
+
+// ValidateToken runs git ls-remote against the repo, since plain git servers
+// have no API to ask. Tokens are either a password for the configured
+// username, or "username:password".
+func (r *gitHostRepo) ValidateToken(token string) (bool, error) {
+	if r.provider.auth == GitAuthNone {
+		token = ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	credentials := gitauth.FromURL(r.gitURL(token))
+	output, err := credentials.Command(ctx, nil, "ls-remote", credentials.URL, "HEAD").CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+
+	if gitAccessDeniedRegex.Match(output) {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("failed to run git ls-remote: %w: %s", err, credentials.Redact(output))
+}
+
+func (r *gitHostRepo) GitURL() string {
+	return r.gitURL(r.token)
+}
+
+// gitURL returns the URL of the repo with the credentials of token.
+func (r *gitHostRepo) gitURL(token string) string {
+	u, err := url.Parse(r.RepoURL())
+	if err != nil {
+		return ""
+	}
+
+	if token != "" {
+		u.User = url.UserPassword(r.provider.credentials(token))
+	}
+
+	return u.String()
+}
+
+func (r *gitHostRepo) Origin() (string, string) {
+	return r.provider.name, r.path
+}
+
+func (r *gitHostRepo) Anonymous() ProviderRepo {
+	return &gitHostRepo{
+		provider: r.provider,
+		path:     r.path,
+	}
+}
+
+func (p *gitHostProvider) credentials(token string) (string, string) {
+	if username, password, ok := strings.Cut(token, ":"); ok {
+		return username, password
+	}
+	return p.username, token
+}
@@ -1,77 +1,245 @@
 package provider
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/costinul/git-rest-cache/logger"
 	"github.com/gin-gonic/gin"
 )
 
-type githubProvider struct{}
+const (
+	githubName     = "github"
+	githubAPIURL   = "https://api.github.com"
+	githubCloneURL = "https://github.com"
+)
+
+type githubProvider struct {
+	name     string
+	apiURL   string
+	cloneURL string
+	route    string
+	client   *http.Client
+	app      *githubApp
+	cfg      *config.Config
+}
 
+// githubRepo is a repo on a GitHub instance. When app is set, token is the
+// caller's client key, and the repo is read with the app's installation
+// tokens instead.
 type githubRepo struct {
-	owner string
-	repo  string
-	token string
+	provider *githubProvider
+	app      *githubApp
+	owner    string
+	repo     string
+	token    string
+}
+
+// newGithubProvider creates the provider of a GitHub instance. Settings left
+// empty default to github.com for the instance named "github", and to the
+// GitHub Enterprise Server layout, with the API under /api/v3, otherwise.
+func newGithubProvider(instance config.GithubInstance, cfg *config.Config) (*githubProvider, error) {
+	if instance.Name == "" || strings.Contains(instance.Name, "/") {
+		return nil, fmt.Errorf("invalid github instance name: %q", instance.Name)
+	}
+
+	cloneURL := strings.TrimSuffix(instance.CloneURL, "/")
+	apiURL := strings.TrimSuffix(instance.APIURL, "/")
+	if instance.Name == githubName {
+		if cloneURL == "" {
+			cloneURL = githubCloneURL
+		}
+		if apiURL == "" {
+			apiURL = githubAPIURL
+		}
+	}
+
+	if cloneURL == "" {
+		return nil, fmt.Errorf("missing clone-url for github instance %s", instance.Name)
+	}
+	if apiURL == "" {
+		apiURL = cloneURL + "/api/v3"
+	}
+
+	for _, u := range []string{cloneURL, apiURL} {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid url for github instance %s: %q", instance.Name, u)
+		}
+	}
+
+	route := path.Clean("/" + instance.Route)
+	if instance.Route == "" {
+		route = "/" + instance.Name
+	}
+	if route == "/" || strings.ContainsAny(route, ":*") {
+		return nil, fmt.Errorf("invalid route for github instance %s: %q", instance.Name, instance.Route)
+	}
+
+	client, err := newHTTPClient(instance.CABundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure github instance %s: %w", instance.Name, err)
+	}
+
+	p := &githubProvider{
+		name:     instance.Name,
+		apiURL:   apiURL,
+		cloneURL: cloneURL,
+		route:    route,
+		client:   client,
+		cfg:      cfg,
+	}
+
+	if instance.AppID != 0 {
+		p.app, err = newGithubApp(instance.AppID, instance.AppPrivateKey, instance.ClientKeys, apiURL, client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure github instance %s: %w", instance.Name, err)
+		}
+	}
+
+	return p, nil
 }
 
 func (p *githubProvider) GetURLPath() string {
-	return "/github/:owner/:repo"
+	return p.route + "/:owner/:repo"
 }
 
 func (p *githubProvider) GetRepo(c *gin.Context) (ProviderRepo, error) {
 	token := c.GetHeader("X-Token")
 
-	return &githubRepo{
-		owner: c.Param("owner"),
-		repo:  c.Param("repo"),
-		token: token,
-	}, nil
+	repo := &githubRepo{
+		provider: p,
+		owner:    c.Param("owner"),
+		repo:     c.Param("repo"),
+		token:    token,
+	}
+
+	// Requests without a client key stay anonymous, so public repos can be
+	// read without one.
+	if token != "" {
+		repo.app = p.app
+	}
+
+	return repo, nil
 }
 
 func (r *githubRepo) Hash() string {
-	return computeRepoHash("github", r.owner, r.repo, r.token)
+	if r.app != nil {
+		return computeRepoHash("github-app|"+r.provider.cloneURL, strconv.FormatInt(r.app.id, 10), r.owner, r.repo)
+	}
+
+	return computeRepoHash("github|"+r.provider.cloneURL, r.token, r.owner, r.repo)
 }
 
 func (r *githubRepo) RepoURL() string {
-	return fmt.Sprintf("https://github.com/%s/%s", r.owner, r.repo)
+	return fmt.Sprintf("%s/%s/%s", r.provider.cloneURL, r.owner, r.repo)
 }
 
 func (r *githubRepo) ValidateToken(token string) (bool, error) {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s", r.owner, r.repo)
+	url := fmt.Sprintf("%s/repos/%s/%s", r.provider.apiURL, r.owner, r.repo)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return false, err
 	}
 
-	req.Header.Set("User-Agent", "git-rest-cache/1.0")
+	if r.app != nil {
+		if !r.app.authorize(token) {
+			return false, nil
+		}
+
+		token, err = r.app.token(r.owner, r.repo)
+		if errors.Is(err, errAppNotInstalled) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
 
 	if token != "" {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	}
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
+	return checkAccessWith(r.provider.client, req)
+}
+
+func (r *githubRepo) GitURL() string {
+	if sshURL := sshGitURL(r.provider.cfg, r.provider.cloneURL, r.owner+"/"+r.repo); sshURL != "" {
+		return sshURL
+	}
+
+	u, err := url.Parse(fmt.Sprintf("%s/%s/%s.git", r.provider.cloneURL, r.owner, r.repo))
 	if err != nil {
-		return false, err
+		return ""
 	}
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		return true, nil
-	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
-		return false, nil
-	default:
-		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if r.app != nil {
+		token, err := r.app.token(r.owner, r.repo)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to get github app token for %s/%s: %v", r.owner, r.repo, err))
+			return u.String()
+		}
+		u.User = url.UserPassword(githubAppTokenUser, token)
+	} else if r.token != "" {
+		u.User = url.User(r.token)
 	}
+
+	return u.String()
 }
 
-func (r *githubRepo) GitURL() string {
-	if r.token != "" {
-		return fmt.Sprintf("https://%s@github.com/%s/%s.git", r.token, r.owner, r.repo)
+// CredentialsExpire reports whether the repo is read with installation
+// tokens, which GitHub expires after an hour.
+func (r *githubRepo) CredentialsExpire() bool {
+	return r.app != nil
+}
+
+func (r *githubRepo) Origin() (string, string) {
+	return r.provider.name, r.owner + "/" + r.repo
+}
+
+func (r *githubRepo) Anonymous() ProviderRepo {
+	return &githubRepo{
+		provider: r.provider,
+		owner:    r.owner,
+		repo:     r.repo,
+	}
+}
+
+// newHTTPClient returns a client for provider APIs that, besides the system
+// roots, trusts the certificates in caBundle when it is set.
+func newHTTPClient(caBundle string) (*http.Client, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	if caBundle == "" {
+		return client, nil
+	}
+
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca bundle: %w", err)
 	}
 
-	return fmt.Sprintf("https://github.com/%s/%s.git", r.owner, r.repo)
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in ca bundle %s", caBundle)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	client.Transport = transport
+
+	return client, nil
 }
@@ -0,0 +1,297 @@
+package provider
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// githubAppTokenUser is the username GitHub expects with installation tokens.
+const githubAppTokenUser = "x-access-token"
+
+// githubAppTokenRefresh is how long before they expire installation tokens are
+// replaced, so a token handed to git doesn't expire in the middle of a fetch.
+const githubAppTokenRefresh = 5 * time.Minute
+
+var errAppNotInstalled = errors.New("github app is not installed")
+
+// errInstallationGone is returned for installations that were removed, such
+// as when the app is reinstalled under a new installation ID.
+var errInstallationGone = errors.New("github app installation is gone")
+
+// githubApp authenticates as a GitHub App. It signs app JWTs with the app's
+// private key and exchanges them for installation tokens, which are cached
+// per account until shortly before they expire.
+type githubApp struct {
+	id         int64
+	key        *rsa.PrivateKey
+	clientKeys []string
+	apiURL     string
+	client     *http.Client
+	now        func() time.Time
+
+	// mu guards the maps, but not the API calls. Those are serialized per
+	// account by the locks in owners, so concurrent requests for an account
+	// share one token while other accounts proceed.
+	mu            sync.Mutex
+	owners        map[string]*sync.Mutex
+	installations map[string]int64
+	tokens        map[int64]installationToken
+}
+
+type installationToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+func newGithubApp(id int64, keyPath string, clientKeys []string, apiURL string, client *http.Client) (*githubApp, error) {
+	if len(clientKeys) == 0 {
+		return nil, fmt.Errorf("github app %d has no client keys", id)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read github app private key: %w", err)
+	}
+
+	key, err := parseRSAPrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse github app private key: %w", err)
+	}
+
+	return &githubApp{
+		id:            id,
+		key:           key,
+		clientKeys:    clientKeys,
+		apiURL:        apiURL,
+		client:        client,
+		now:           time.Now,
+		owners:        make(map[string]*sync.Mutex),
+		installations: make(map[string]int64),
+		tokens:        make(map[int64]installationToken),
+	}, nil
+}
+
+func parseRSAPrivateKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+
+	return rsaKey, nil
+}
+
+// authorize checks the key a caller presented in place of GitHub credentials.
+func (a *githubApp) authorize(clientKey string) bool {
+	for _, key := range a.clientKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(clientKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// token returns an installation token of the installation that covers the
+// repo, or errAppNotInstalled when the app can't access it. An installation
+// that is gone is looked up again, so that a reinstalled app is picked up.
+func (a *githubApp) token(owner, repo string) (string, error) {
+	ownerLock := a.ownerLock(owner)
+	ownerLock.Lock()
+	defer ownerLock.Unlock()
+
+	for {
+		a.mu.Lock()
+		installationID, cached := a.installations[owner]
+		token, ok := a.tokens[installationID]
+		a.mu.Unlock()
+
+		if !cached {
+			id, err := a.findInstallation(owner, repo)
+			if err != nil {
+				return "", err
+			}
+			installationID = id
+
+			a.mu.Lock()
+			a.installations[owner] = id
+			token, ok = a.tokens[id]
+			a.mu.Unlock()
+		}
+
+		if ok && a.now().Add(githubAppTokenRefresh).Before(token.expiresAt) {
+			return token.token, nil
+		}
+
+		token, err := a.createToken(installationID)
+		if errors.Is(err, errInstallationGone) {
+			a.mu.Lock()
+			delete(a.installations, owner)
+			delete(a.tokens, installationID)
+			a.mu.Unlock()
+			if cached {
+				continue
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+
+		a.mu.Lock()
+		a.tokens[installationID] = token
+		a.mu.Unlock()
+
+		return token.token, nil
+	}
+}
+
+func (a *githubApp) ownerLock(owner string) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lock, ok := a.owners[owner]
+	if !ok {
+		lock = &sync.Mutex{}
+		a.owners[owner] = lock
+	}
+	return lock
+}
+
+func (a *githubApp) findInstallation(owner, repo string) (int64, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+
+	installationURL := fmt.Sprintf("%s/repos/%s/%s/installation", a.apiURL, url.PathEscape(owner), url.PathEscape(repo))
+	status, err := a.request("GET", installationURL, &installation)
+	if err != nil {
+		return 0, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return installation.ID, nil
+	case http.StatusNotFound:
+		return 0, errAppNotInstalled
+	default:
+		return 0, fmt.Errorf("failed to find github app installation: unexpected status code: %d", status)
+	}
+}
+
+func (a *githubApp) createToken(installationID int64) (installationToken, error) {
+	var response struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	tokenURL := fmt.Sprintf("%s/app/installations/%d/access_tokens", a.apiURL, installationID)
+	status, err := a.request("POST", tokenURL, &response)
+	if err != nil {
+		return installationToken{}, err
+	}
+
+	if status == http.StatusNotFound || status == http.StatusUnauthorized {
+		return installationToken{}, errInstallationGone
+	}
+
+	if status != http.StatusCreated {
+		return installationToken{}, fmt.Errorf("failed to create github app installation token: unexpected status code: %d", status)
+	}
+
+	return installationToken{token: response.Token, expiresAt: response.ExpiresAt}, nil
+}
+
+// request calls the API as the app itself and decodes successful responses
+// into result.
+func (a *githubApp) request(method, requestURL string, result any) (int, error) {
+	jwt, err := a.jwt()
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "git-rest-cache/1.0")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return 0, fmt.Errorf("failed to decode github response: %w", err)
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// jwt returns a JWT that authenticates as the app. It is backdated a minute
+// to allow for clock drift, and lives for less than GitHub's 10 minute limit.
+func (a *githubApp) jwt() (string, error) {
+	now := a.now()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.id, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var token bytes.Buffer
+	token.WriteString(base64.RawURLEncoding.EncodeToString(header))
+	token.WriteByte('.')
+	token.WriteString(base64.RawURLEncoding.EncodeToString(claims))
+
+	digest := sha256.Sum256(token.Bytes())
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign github app jwt: %w", err)
+	}
+
+	token.WriteByte('.')
+	token.WriteString(base64.RawURLEncoding.EncodeToString(signature))
+
+	return token.String(), nil
+}
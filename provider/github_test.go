@@ -0,0 +1,129 @@
+package provider
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGithubEnterpriseValidateToken(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v3/repos/corp/tools" && r.Header.Get("Authorization") == "Bearer valid" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caBundle, certificate, 0644))
+
+	p, err := newGithubProvider(config.GithubInstance{Name: "ghe-corp", CloneURL: server.URL, CABundle: caBundle}, nil)
+	require.NoError(t, err)
+
+	repo := &githubRepo{provider: p, owner: "corp", repo: "tools"}
+	valid, err := repo.ValidateToken("valid")
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = repo.ValidateToken("invalid")
+	require.NoError(t, err)
+	assert.False(t, valid)
+
+	untrusted, err := newGithubProvider(config.GithubInstance{Name: "ghe-corp", CloneURL: server.URL}, nil)
+	require.NoError(t, err)
+	_, err = (&githubRepo{provider: untrusted, owner: "corp", repo: "tools"}).ValidateToken("valid")
+	assert.Error(t, err, "the instance's certificate should only be trusted with its ca bundle")
+}
+
+func TestGithubInstances(t *testing.T) {
+	pm, err := NewDefaultProviderManager(&config.Config{
+		GithubInstances: []config.GithubInstance{
+			{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com/"},
+			{Name: "ghe-lab", CloneURL: "https://ghe.lab.example.com", APIURL: "https://api.ghe.lab.example.com", Route: "/lab/"},
+		},
+	})
+	require.NoError(t, err)
+
+	public := pm.GetProvider("github").(*githubProvider)
+	assert.Equal(t, "/github/:owner/:repo", public.GetURLPath())
+	assert.Equal(t, githubAPIURL, public.apiURL)
+
+	corp := pm.GetProvider("ghe-corp").(*githubProvider)
+	assert.Equal(t, "/ghe-corp/:owner/:repo", corp.GetURLPath())
+	assert.Equal(t, "https://ghe.corp.example.com/api/v3", corp.apiURL)
+
+	lab := pm.GetProvider("ghe-lab").(*githubProvider)
+	assert.Equal(t, "/lab/:owner/:repo", lab.GetURLPath())
+	assert.Equal(t, "https://api.ghe.lab.example.com", lab.apiURL)
+
+	repo := &githubRepo{provider: corp, owner: "corp", repo: "tools", token: "secret"}
+	assert.Equal(t, "https://secret@ghe.corp.example.com/corp/tools.git", repo.GitURL())
+	assert.Equal(t, "https://ghe.corp.example.com/corp/tools.git", repo.Anonymous().GitURL())
+
+	other := &githubRepo{provider: public, owner: "corp", repo: "tools", token: "secret"}
+	assert.NotEqual(t, repo.Hash(), other.Hash(), "instances should not share caches")
+
+	for _, instances := range [][]config.GithubInstance{
+		{{Name: "ghe-corp"}},
+		{{Name: "gitlab", CloneURL: "https://ghe.corp.example.com"}},
+		{{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", CABundle: filepath.Join(t.TempDir(), "missing.pem")}},
+		{{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", Route: "/"}},
+		{{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", Route: "/gitlab"}},
+		{{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", Route: "/git"}},
+		{{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", Route: "/github/"}},
+		{{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", Route: "/stats"}},
+		{{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", Route: "/:corp"}},
+		{
+			{Name: "ghe-corp", CloneURL: "https://ghe.corp.example.com", Route: "/ghe"},
+			{Name: "ghe-lab", CloneURL: "https://ghe.lab.example.com", Route: "ghe"},
+		},
+	} {
+		_, err := NewDefaultProviderManager(&config.Config{
+			GithubInstances: instances,
+			GitHosts:        []config.GitHost{{Name: "forge", URL: "https://forge.example.com"}},
+		})
+		assert.Error(t, err, "%+v", instances)
+	}
+}
+
+func TestSSHRemotes(t *testing.T) {
+	cfg := &config.Config{
+		GitlabURL: "https://gitlab.com",
+		SSHKeys: []config.SSHKey{
+			{Host: "github.com", Path: "corp", Key: "/keys/corp"},
+			{Host: "gitlab.com", Path: "group/sub", Key: "/keys/sub"},
+			{Host: "bitbucket.org", Path: "acme/widgets", Key: "/keys/widgets", User: "deploy"},
+		},
+	}
+	pm, err := NewDefaultProviderManager(cfg)
+	require.NoError(t, err)
+
+	github := pm.GetProvider("github").(*githubProvider)
+	gitlab := pm.GetProvider("gitlab").(*gitlabProvider)
+	bitbucket := pm.GetProvider("bitbucket").(*bitbucketCloudProvider)
+
+	tests := []struct {
+		repo ProviderRepo
+		want string
+	}{
+		{repo: &githubRepo{provider: github, owner: "corp", repo: "tools", token: "secret"}, want: "git@github.com:corp/tools.git"},
+		{repo: &githubRepo{provider: github, owner: "other", repo: "tools", token: "secret"}, want: "https://secret@github.com/other/tools.git"},
+		{repo: &gitlabRepo{provider: gitlab, namespace: "group/sub/deep", repo: "repo"}, want: "git@gitlab.com:group/sub/deep/repo.git"},
+		{repo: &bitbucketCloudRepo{provider: bitbucket, workspace: "acme", repo: "widgets"}, want: "deploy@bitbucket.org:acme/widgets.git"},
+		{repo: &bitbucketCloudRepo{provider: bitbucket, workspace: "acme", repo: "other"}, want: "https://bitbucket.org/acme/other.git"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.repo.GitURL())
+	}
+}
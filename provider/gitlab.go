@@ -0,0 +1,122 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/costinul/git-rest-cache/config"
+	"github.com/gin-gonic/gin"
+)
+
+type gitlabProvider struct {
+	baseURL string
+	cfg     *config.Config
+}
+
+type gitlabRepo struct {
+	provider  *gitlabProvider
+	namespace string
+	repo      string
+	token     string
+}
+
+func newGitlabProvider(baseURL string, cfg *config.Config) *gitlabProvider {
+	return &gitlabProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		cfg:     cfg,
+	}
+}
+
+func (p *gitlabProvider) GetURLPath() string {
+	return "/gitlab"
+}
+
+func (p *gitlabProvider) IsNested() bool {
+	return true
+}
+
+func (p *gitlabProvider) GetRepo(c *gin.Context) (ProviderRepo, error) {
+	repoPath := strings.Trim(c.Param(RepoPathParam), "/")
+	idx := strings.LastIndex(repoPath, "/")
+	if idx <= 0 {
+		return nil, fmt.Errorf("invalid gitlab repo path: %s", repoPath)
+	}
+
+	return &gitlabRepo{
+		provider:  p,
+		namespace: repoPath[:idx],
+		repo:      repoPath[idx+1:],
+		token:     c.GetHeader("X-Token"),
+	}, nil
+}
+
+func (r *gitlabRepo) Hash() string {
+	return computeRepoHash("gitlab|"+r.provider.baseURL, r.token, r.namespace, r.repo)
+}
+
+func (r *gitlabRepo) RepoURL() string {
+	return fmt.Sprintf("%s/%s/%s", r.provider.baseURL, r.namespace, r.repo)
+}
+
+// ValidateToken tries the token as a personal, project or group access token
+// first, and falls back to an OAuth bearer token.
+func (r *gitlabRepo) ValidateToken(token string) (bool, error) {
+	projectURL := fmt.Sprintf("%s/api/v4/projects/%s", r.provider.baseURL, url.PathEscape(r.namespace+"/"+r.repo))
+
+	headers := []string{""}
+	if token != "" {
+		headers = []string{"PRIVATE-TOKEN", "Authorization"}
+	}
+
+	for _, header := range headers {
+		req, err := http.NewRequest("GET", projectURL, nil)
+		if err != nil {
+			return false, err
+		}
+
+		switch header {
+		case "PRIVATE-TOKEN":
+			req.Header.Set(header, token)
+		case "Authorization":
+			req.Header.Set(header, fmt.Sprintf("Bearer %s", token))
+		}
+
+		valid, err := checkAccess(req)
+		if err != nil || valid {
+			return valid, err
+		}
+	}
+
+	return false, nil
+}
+
+func (r *gitlabRepo) GitURL() string {
+	if sshURL := sshGitURL(r.provider.cfg, r.provider.baseURL, r.namespace+"/"+r.repo); sshURL != "" {
+		return sshURL
+	}
+
+	u, err := url.Parse(fmt.Sprintf("%s/%s/%s.git", r.provider.baseURL, r.namespace, r.repo))
+	if err != nil {
+		return ""
+	}
+
+	if r.token != "" {
+		u.User = url.UserPassword("oauth2", r.token)
+	}
+
+	return u.String()
+}
+
+func (r *gitlabRepo) Origin() (string, string) {
+	return "gitlab", r.namespace + "/" + r.repo
+}
+
+func (r *gitlabRepo) Anonymous() ProviderRepo {
+	return &gitlabRepo{
+		provider:  r.provider,
+		namespace: r.namespace,
+		repo:      r.repo,
+	}
+}
@@ -2,8 +2,16 @@ package provider
 
 import (
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
-
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/costinul/git-rest-cache/config"
 	"github.com/gin-gonic/gin"
 )
 
@@ -12,6 +20,16 @@ type ProviderRepo interface {
 	RepoURL() string
 	ValidateToken(token string) (bool, error)
 	GitURL() string
+	// Origin returns the name of the provider and the path of the repo in it,
+	// such as "github" and "owner/repo".
+	Origin() (provider, path string)
+	Anonymous() ProviderRepo
+}
+
+// ExpiringRepo is implemented by repos whose GitURL holds credentials that
+// expire, and which must therefore be asked for it again before git runs.
+type ExpiringRepo interface {
+	CredentialsExpire() bool
 }
 
 type Provider interface {
@@ -19,6 +37,17 @@ type Provider interface {
 	GetRepo(c *gin.Context) (ProviderRepo, error)
 }
 
+// NestedProvider is implemented by providers whose repos live under a
+// variable number of path segments, which gin's :param routing can't express.
+// Their routes take the form <url path>/<repo path...>/-/<ref>/<action>/...,
+// and GetRepo finds the repo path in the RepoPathParam param.
+type NestedProvider interface {
+	Provider
+	IsNested() bool
+}
+
+const RepoPathParam = "repoPath"
+
 type ProviderManager interface {
 	GetProviders() []Provider
 	GetProvider(name string) Provider
@@ -32,12 +61,102 @@ const (
 	REPO_HASH_SALT = "d57bbdf3b5614008a74b20891834d223"
 )
 
-func NewDefaultProviderManager() *DefaultProviderManager {
+func NewDefaultProviderManager(cfg *config.Config) (*DefaultProviderManager, error) {
+	providers := map[string]Provider{
+		"gitlab":    newGitlabProvider(cfg.GitlabURL, cfg),
+		"bitbucket": newBitbucketCloudProvider(cfg),
+		"devops":    newDevopsProvider(),
+	}
+
+	if cfg.BitbucketServerURL != "" {
+		providers["bitbucket-server"] = newBitbucketServerProvider(cfg.BitbucketServerURL)
+	}
+
+	instances := cfg.GithubInstances
+	if !hasGithubInstance(instances, githubName) {
+		instances = append([]config.GithubInstance{{Name: githubName}}, instances...)
+	}
+
+	for _, instance := range instances {
+		p, err := newGithubProvider(instance, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := providers[instance.Name]; exists {
+			return nil, fmt.Errorf("duplicate provider: %s", instance.Name)
+		}
+		providers[instance.Name] = p
+	}
+
+	for _, host := range cfg.GitHosts {
+		p, err := newGitHostProvider(host)
+		if err != nil {
+			return nil, err
+		}
+
+		name := "git/" + host.Name
+		if _, exists := providers[name]; exists {
+			return nil, fmt.Errorf("duplicate git host: %s", host.Name)
+		}
+		providers[name] = p
+	}
+
+	if err := checkRoutes(providers); err != nil {
+		return nil, err
+	}
+
 	return &DefaultProviderManager{
-		providers: map[string]Provider{
-			"github": &githubProvider{},
-		},
+		providers: providers,
+	}, nil
+}
+
+// reservedRoutes are served by the API itself.
+var reservedRoutes = []string{"/stats", "/webhooks"}
+
+// checkRoutes rejects providers whose routes overlap, since the router can't
+// tell them apart. Routes are compared by their static prefix, the segments
+// before the first parameter.
+func checkRoutes(providers map[string]Provider) error {
+	// owners maps the prefixes seen so far to what they route to.
+	owners := make(map[string]string)
+	for _, route := range reservedRoutes {
+		owners[route] = "the route " + route
+	}
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prefix := staticPrefix(providers[name].GetURLPath())
+		for other, owner := range owners {
+			if prefix == other || strings.HasPrefix(prefix, other+"/") || strings.HasPrefix(other, prefix+"/") {
+				return fmt.Errorf("route %s of provider %s overlaps %s", providers[name].GetURLPath(), name, owner)
+			}
+		}
+		owners[prefix] = "provider " + name
 	}
+
+	return nil
+}
+
+func staticPrefix(route string) string {
+	if i := strings.IndexAny(route, ":*"); i >= 0 {
+		route = route[:i]
+	}
+	return strings.TrimSuffix(route, "/")
+}
+
+func hasGithubInstance(instances []config.GithubInstance, name string) bool {
+	for _, instance := range instances {
+		if instance.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (pm *DefaultProviderManager) GetProviders() []Provider {
@@ -48,15 +167,23 @@ func (pm *DefaultProviderManager) GetProviders() []Provider {
 	return providers
 }
 
-func computeRepoHash(provider, owner, repo, token string) string {
+// computeRepoHash hashes the provider, every segment of the repo path and the
+// token. Each field is length-prefixed, so that a/bc and ab/c, or a token that
+// happens to look like a path segment, can never map to the same cache.
+func computeRepoHash(provider, token string, path ...string) string {
 	hash := sha1.New()
 
-	hash.Write([]byte(provider))
-	hash.Write([]byte(owner))
-	hash.Write([]byte(repo))
+	writeField := func(field string) {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(field)))
+		hash.Write(size[:])
+		hash.Write([]byte(field))
+	}
 
-	if token != "" {
-		hash.Write([]byte(token))
+	writeField(provider)
+	writeField(token)
+	for _, segment := range path {
+		writeField(segment)
 	}
 
 	hash.Write([]byte(REPO_HASH_SALT))
@@ -69,3 +196,51 @@ func computeRepoHash(provider, owner, repo, token string) string {
 func (pm *DefaultProviderManager) GetProvider(name string) Provider {
 	return pm.providers[name]
 }
+
+// sshGitURL returns the scp-like SSH remote of a repo when a deploy key is
+// configured for it, and an empty string otherwise.
+func sshGitURL(cfg *config.Config, cloneURL, repoPath string) string {
+	if cfg == nil {
+		return ""
+	}
+
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return ""
+	}
+
+	key, ok := cfg.SSHKeyFor(u.Hostname(), repoPath)
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%s@%s:%s.git", key.User, u.Hostname(), repoPath)
+}
+
+// checkAccess runs a provider API request and maps its status to whether the
+// credentials it carries can read the repo.
+func checkAccess(req *http.Request) (bool, error) {
+	return checkAccessWith(&http.Client{Timeout: 5 * time.Second}, req)
+}
+
+func checkAccessWith(client *http.Client, req *http.Request) (bool, error) {
+	req.Header.Set("User-Agent", "git-rest-cache/1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	case http.StatusNonAuthoritativeInfo:
+		// Azure DevOps answers rejected credentials with a sign-in page.
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}